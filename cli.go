@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tonytwostep/grsync-tui/lib"
+)
+
+const commandUsage = `Usage: grsync-tui [flags] [command]
+
+Without a command the TUI is started. Commands:
+  list [--new] [--json]                 List the photos on the camera
+  info [--json] <dir/file>              Show details of a photo
+  download [--json] [--new | names...]  Download photos, by name or every new one
+  preview [--width N] [--json] <file>   Print a photo as ASCII art
+  watch                                 Import new photos every time the camera connects
+
+Flags:
+`
+
+// photoEntry is a photo in the output of list
+type photoEntry struct {
+	Name      string `json:"name"`
+	Imported  bool   `json:"imported"`
+	LocalPath string `json:"local_path,omitempty"`
+	Collision bool   `json:"collision,omitempty"` // a different photo has its local name
+}
+
+// photoDetails is the output of info
+type photoDetails struct {
+	Name        string   `json:"name"`
+	Size        int64    `json:"size"`
+	Captured    string   `json:"captured,omitempty"`
+	Model       string   `json:"model,omitempty"`
+	Imported    bool     `json:"imported"`
+	LocalPath   string   `json:"local_path,omitempty"`
+	Av          string   `json:"av,omitempty"`
+	Tv          string   `json:"tv,omitempty"`
+	Sv          string   `json:"sv,omitempty"`
+	Xv          string   `json:"xv,omitempty"`
+	AspectRatio string   `json:"aspect_ratio,omitempty"`
+	GpsInfo     string   `json:"gps_info,omitempty"`
+	Rating      int      `json:"rating,omitempty"`
+	Keywords    []string `json:"keywords,omitempty"`
+}
+
+// previewOutput is the output of preview --json
+type previewOutput struct {
+	Name  string   `json:"name"`
+	Lines []string `json:"lines"`
+}
+
+// runCommand runs a subcommand and returns the exit code
+func runCommand(args []string) int {
+	switch args[0] {
+	case "list":
+		return listCommand(args[1:])
+	case "info":
+		return infoCommand(args[1:])
+	case "download":
+		return downloadCommand(args[1:])
+	case "preview":
+		return previewCommand(args[1:])
+	case "watch":
+		return watchCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", args[0])
+		flag.Usage()
+		return exitError
+	}
+}
+
+func printJSON(v interface{}) {
+	encoder := json.NewEncoder(cmdOut)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// scanForCommand checks the camera is there and lists its photos along with
+// which are already imported
+func scanForCommand() (onCamera []string, existing map[string]bool, collisions map[string]bool, ok bool) {
+	if !lib.CameraConnected(cfg) {
+		fmt.Fprintf(os.Stderr, "Camera not reachable via %s\n", cfg.ConnectionMethod)
+		return nil, nil, nil, false
+	}
+	onCamera, err := lib.ScanCamera(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, nil, false
+	}
+	existing = make(map[string]bool)
+	collisions = lib.ScanDownloadDir(existing, onCamera, cfg)
+	return onCamera, existing, collisions, true
+}
+
+// resolveNames matches names against the camera, accepting a file such as
+// 100RICOH/R0001234.JPG or a shot such as 100RICOH/R0001234, which stands for
+// its files that pass the format filter
+func resolveNames(names, onCamera []string) ([]string, error) {
+	filter, err := lib.ParseFormatFilter(string(cfg.FormatFilter))
+	if err != nil {
+		return nil, err
+	}
+	groups := lib.GroupPhotos(onCamera)
+
+	var files []string
+	for _, name := range names {
+		if onCameraHas(name, onCamera) {
+			files = append(files, name)
+			continue
+		}
+		found := false
+		for _, group := range groups {
+			if strings.EqualFold(group.Base, name) {
+				files = append(files, group.Filtered(filter)...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s is not on the camera", name)
+		}
+	}
+	return files, nil
+}
+
+func onCameraHas(name string, onCamera []string) bool {
+	for _, file := range onCamera {
+		if file == name {
+			return true
+		}
+	}
+	return false
+}
+
+func listCommand(args []string) int {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print JSON")
+	onlyNew := flags.Bool("new", false, "only list photos that haven't been imported")
+	flags.Parse(args)
+
+	onCamera, existing, collisions, ok := scanForCommand()
+	if !ok {
+		return exitError
+	}
+
+	entries := []photoEntry{}
+	for _, name := range onCamera {
+		if *onlyNew && existing[name] {
+			continue
+		}
+		entry := photoEntry{Name: name, Imported: existing[name], Collision: collisions[name]}
+		if entry.Imported {
+			entry.LocalPath = lib.ImportedPath(name, cfg)
+		}
+		entries = append(entries, entry)
+	}
+
+	if *asJSON {
+		printJSON(entries)
+		return exitOK
+	}
+	for _, entry := range entries {
+		status := "new"
+		switch {
+		case entry.Imported:
+			status = "imported " + entry.LocalPath
+		case entry.Collision:
+			status = "new, name taken by a different local photo"
+		}
+		fmt.Fprintf(cmdOut, "%s\t%s\n", entry.Name, status)
+	}
+	return exitOK
+}
+
+func infoCommand(args []string) int {
+	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print JSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: grsync-tui info [--json] <dir/file>")
+		return exitError
+	}
+	name := flags.Arg(0)
+
+	onCamera, existing, _, ok := scanForCommand()
+	if !ok {
+		return exitError
+	}
+	if !onCameraHas(name, onCamera) {
+		fmt.Fprintf(os.Stderr, "%s is not on the camera\n", name)
+		return exitError
+	}
+
+	camera, err := lib.PhotoDetails(name, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	size, captured, _ := lib.GetFileInfo(name, cfg, existing)
+	tags := lib.TagsFor(name)
+	details := photoDetails{
+		Name:        name,
+		Size:        size,
+		Model:       camera.CameraModel,
+		Imported:    existing[name],
+		Av:          camera.Av,
+		Tv:          camera.Tv,
+		Sv:          camera.Sv,
+		Xv:          camera.Xv,
+		AspectRatio: camera.AspectRatio,
+		GpsInfo:     camera.GpsInfo,
+		Rating:      tags.Rating,
+		Keywords:    tags.Keywords,
+	}
+	if !captured.IsZero() {
+		details.Captured = captured.Format(time.RFC3339)
+	}
+	if details.Imported {
+		details.LocalPath = lib.ImportedPath(name, cfg)
+	}
+
+	if *asJSON {
+		printJSON(details)
+		return exitOK
+	}
+	fmt.Fprintf(cmdOut, "File:      %s\n", details.Name)
+	fmt.Fprintf(cmdOut, "Filesize:  %s\n", formatMB(details.Size))
+	fmt.Fprintf(cmdOut, "Captured:  %s\n", details.Captured)
+	fmt.Fprintf(cmdOut, "Model:     %s\n", details.Model)
+	if details.Imported {
+		fmt.Fprintf(cmdOut, "Imported:  %s\n", details.LocalPath)
+	} else {
+		fmt.Fprintf(cmdOut, "Imported:  no\n")
+	}
+	for _, row := range [][2]string{
+		{"Aperture", details.Av},
+		{"Shutter", details.Tv},
+		{"ISO", details.Sv},
+		{"Exp. comp", details.Xv},
+		{"Aspect", details.AspectRatio},
+		{"GPS", details.GpsInfo},
+	} {
+		if row[1] != "" {
+			fmt.Fprintf(cmdOut, "%-10s %s\n", row[0]+":", row[1])
+		}
+	}
+	return exitOK
+}
+
+func downloadCommand(args []string) int {
+	flags := flag.NewFlagSet("download", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print a JSON summary, progress goes to stderr")
+	onlyNew := flags.Bool("new", false, "download every photo that hasn't been imported")
+	flags.Parse(args)
+	if *onlyNew == (flags.NArg() > 0) {
+		fmt.Fprintln(os.Stderr, "Usage: grsync-tui download [--json] [--new | names...]")
+		return exitError
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logf := plainLog
+	if *asJSON {
+		// Keep stdout for the summary
+		logf = func(level lib.LogLevel, message string) {
+			fmt.Fprintf(os.Stderr, "%s %s\n", time.Now().Format("2006-01-02 15:04:05"), message)
+		}
+	}
+
+	onCamera, existing, _, ok := scanForCommand()
+	if !ok {
+		return exitError
+	}
+	var files []string
+	if *onlyNew {
+		filter, err := lib.ParseFormatFilter(string(cfg.FormatFilter))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		for _, name := range onCamera {
+			if !existing[name] && filter.Matches(name) {
+				files = append(files, name)
+			}
+		}
+	} else {
+		var err error
+		if files, err = resolveNames(flags.Args(), onCamera); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+	}
+
+	summary, code := importFiles(ctx, files, logf)
+	if *asJSON {
+		printJSON(summary)
+	}
+	if ctx.Err() != nil {
+		return exitInterrupted
+	}
+	if code != exitOK {
+		return code
+	}
+	return summary.exitCode()
+}
+
+func previewCommand(args []string) int {
+	flags := flag.NewFlagSet("preview", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print JSON")
+	width := flags.Int("width", 80, "width in characters")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: grsync-tui preview [--width N] [--json] <file>")
+		return exitError
+	}
+	name := flags.Arg(0)
+
+	onCamera, existing, _, ok := scanForCommand()
+	if !ok {
+		return exitError
+	}
+	if !onCameraHas(name, onCamera) {
+		fmt.Fprintf(os.Stderr, "%s is not on the camera\n", name)
+		return exitError
+	}
+
+	img, err := lib.LoadPreview(name, existing[name], cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't load preview: %v\n", err)
+		return exitError
+	}
+	lines := lib.ASCIIArt(img, *width)
+
+	if *asJSON {
+		printJSON(previewOutput{Name: name, Lines: lines})
+		return exitOK
+	}
+	fmt.Fprintln(cmdOut, strings.Join(lines, "\n"))
+	return exitOK
+}
+
+func watchCommand(args []string) int {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	flags.Parse(args)
+	return runAutoImport(true, journalLog)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/tonytwostep/grsync-tui/lib"
+)
+
+// configFlags override settings from the config file for a single run. The
+// file itself is never rewritten with them.
+type configFlags struct {
+	file        *string
+	profile     *string
+	method      *string
+	downloadDir *string
+	cameraDir   *string
+	host        *string
+	mock        *bool
+}
+
+func registerConfigFlags() configFlags {
+	return configFlags{
+		file:        flag.String("config", "", "read the config from this file instead of $XDG_CONFIG_HOME/grsync-tui.json"),
+		profile:     flag.String("profile", "", "use the named profile from the config"),
+		method:      flag.String("method", "", "connection method, usb or wifi"),
+		downloadDir: flag.String("download-dir", "", "directory to download photos to"),
+		cameraDir:   flag.String("camera-dir", "", "path to the mounted camera (USB)"),
+		host:        flag.String("host", "", "base URL of the camera (WiFi)"),
+		mock:        flag.Bool("mock", false, "simulate a WiFi camera using the files in ./mock"),
+	}
+}
+
+// apply layers the flags that were given over cfg
+func (f configFlags) apply(cfg *lib.Config) error {
+	if *f.method != "" {
+		switch method := lib.ConnectionMethod(*f.method); method {
+		case lib.ConnectionMethodUSB, lib.ConnectionMethodWiFi:
+			cfg.ConnectionMethod = method
+		default:
+			return fmt.Errorf("unknown connection method %q, use usb or wifi", *f.method)
+		}
+	}
+	if *f.downloadDir != "" {
+		dir, err := filepath.Abs(*f.downloadDir)
+		if err != nil {
+			return err
+		}
+		cfg.DownloadDir = dir
+	}
+	if *f.cameraDir != "" {
+		dir, err := filepath.Abs(*f.cameraDir)
+		if err != nil {
+			return err
+		}
+		cfg.UsbSettings.CameraDir = dir
+	}
+	if *f.host != "" {
+		cfg.WifiSettings.Host = *f.host
+	}
+	if *f.mock {
+		cfg.Mock = true
+	}
+	return nil
+}
+
+// effectiveConfig layers a profile and then the flags over a config as read
+// from the file
+func effectiveConfig(base lib.Config, profile string) (lib.Config, error) {
+	c, err := base.WithProfile(profile)
+	if err != nil {
+		return c, err
+	}
+	return c, overrides.apply(&c)
+}
+
+// loadConfig reads the config file and sets cfg from it. Problems with the
+// config end the run, except in the TUI where the user can pick what to do.
+func loadConfig(tui bool) {
+	var cfgErr *lib.ConfigError
+	var err error
+	fileCfg, err = lib.LoadConfig()
+	if errors.Is(err, lib.ErrConfigMissing) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+	if err != nil && !errors.As(err, &cfgErr) {
+		// Only the first-run config couldn't be saved, the defaults still work
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	profile := *overrides.profile
+	if profile == "" {
+		profile = fileCfg.DefaultProfile
+	}
+	if profile == "" && tui && cfgErr == nil && len(fileCfg.Profiles) > 0 {
+		profile = pickProfile()
+	}
+
+	for {
+		if cfgErr == nil {
+			if cfg, err = effectiveConfig(fileCfg, profile); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(exitError)
+			}
+			errors.As(lib.ValidateConfig(cfg), &cfgErr)
+		}
+		if cfgErr == nil {
+			return
+		}
+		if !tui {
+			fmt.Fprintln(os.Stderr, cfgErr)
+			os.Exit(exitError)
+		}
+
+		switch showConfigError(cfgErr) {
+		case "Reset to defaults":
+			var backup string
+			if fileCfg, backup, err = lib.ResetConfig(); err != nil {
+				fmt.Println("Couldn't reset config:", err)
+				os.Exit(exitError)
+			}
+			fmt.Println("Wrote a default config, the old one was moved to", backup)
+		case "Use defaults":
+			fileCfg = lib.DefaultConfig()
+			brokenConfig = true
+		default:
+			os.Exit(exitError)
+		}
+		// The defaults have no profiles
+		profile = ""
+		cfgErr = nil
+	}
+}
+
+// setupEvents sends the event stream to path, or stdout for "-", in which case
+// everything else is written to stderr. The TUI needs the terminal to itself,
+// so it can only write events to a file.
+func setupEvents(path string, tui bool) error {
+	if path == "-" {
+		if tui {
+			return fmt.Errorf("--events - needs --auto or a command, use a file with the TUI")
+		}
+		lib.SetEventWriter(os.Stdout)
+		logOut = os.Stderr
+		cmdOut = os.Stderr
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't open event file: %w", err)
+	}
+	lib.SetEventWriter(f)
+	return nil
+}
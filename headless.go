@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/tonytwostep/grsync-tui/lib"
+)
+
+// Exit codes of the headless modes
+const (
+	exitOK          = 0
+	exitFailed      = 1 // some photos failed to download
+	exitError       = 2 // the camera couldn't be scanned or the config is unusable
+	exitNoSpace     = 3 // the new photos don't fit in download_dir
+	exitInterrupted = 130
+)
+
+// How often the camera is checked while waiting for it to connect or go away
+const connectionPollInterval = 2 * time.Second
+
+// Where plain log lines and command output go, both move to stderr when
+// stdout carries events
+var (
+	logOut io.Writer = os.Stdout
+	cmdOut io.Writer = os.Stdout
+)
+
+// importSummary describes one automatic import
+type importSummary struct {
+	Files    int            `json:"files"`
+	Imported int            `json:"imported"`
+	Skipped  int            `json:"skipped"`
+	Failed   int            `json:"failed"`
+	Bytes    int64          `json:"bytes"`
+	Seconds  float64        `json:"seconds"`
+	Results  []importResult `json:"results"`
+}
+
+// importResult is the outcome for a single photo
+type importResult struct {
+	Name      string `json:"name"`
+	LocalPath string `json:"local_path,omitempty"`
+	Skipped   string `json:"skipped,omitempty"` // why the collision policy skipped it
+	Error     string `json:"error,omitempty"`
+}
+
+func (s importSummary) exitCode() int {
+	if s.Failed > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// plainLog prints import messages as plain lines, errors to stderr
+func plainLog(level lib.LogLevel, message string) {
+	line := fmt.Sprintf("%s %s", time.Now().Format("2006-01-02 15:04:05"), message)
+	if level == lib.LogError {
+		fmt.Fprintln(os.Stderr, line)
+		return
+	}
+	fmt.Fprintln(logOut, line)
+}
+
+// journalLog prints logfmt lines for running as a service. Under systemd,
+// where journald adds its own timestamps, each line starts with a syslog
+// priority instead so errors are told apart.
+func journalLog(level lib.LogLevel, message string) {
+	name, priority := "info", 6
+	if level == lib.LogError {
+		name, priority = "error", 3
+	}
+	line := fmt.Sprintf("level=%s msg=%s", name, strconv.Quote(message))
+	if os.Getenv("JOURNAL_STREAM") != "" {
+		fmt.Fprintf(logOut, "<%d>%s\n", priority, line)
+		return
+	}
+	fmt.Fprintf(logOut, "time=%s %s\n", time.Now().Format(time.RFC3339), line)
+}
+
+// runAutoImport waits for the camera and downloads every photo that hasn't
+// been imported yet without any interaction. With loop set it waits for the
+// camera to go away and connect again instead of exiting, until it gets
+// SIGINT or SIGTERM. It returns the exit code.
+func runAutoImport(loop bool, logf lib.LogFunc) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// A stopped loop is a clean shutdown, a single import was cut short
+	interrupted := exitInterrupted
+	if loop {
+		interrupted = exitOK
+	}
+
+	for {
+		logf(lib.LogInfo, fmt.Sprintf("Waiting for camera via %s", cfg.ConnectionMethod))
+		lib.EmitConnection("waiting", cfg.ConnectionMethod)
+		if !waitForCamera(ctx, true) {
+			logf(lib.LogInfo, "Shutting down")
+			return interrupted
+		}
+		logf(lib.LogInfo, "Camera connected")
+		lib.EmitConnection("connected", cfg.ConnectionMethod)
+
+		summary, code := importNew(ctx, logf)
+		if ctx.Err() != nil {
+			logf(lib.LogInfo, "Shutting down")
+			return interrupted
+		}
+		if !loop {
+			if code != exitOK {
+				return code
+			}
+			return summary.exitCode()
+		}
+
+		logf(lib.LogInfo, "Waiting for the camera to disconnect")
+		if !waitForCamera(ctx, false) {
+			logf(lib.LogInfo, "Shutting down")
+			return interrupted
+		}
+		logf(lib.LogInfo, "Camera disconnected")
+		lib.EmitConnection("disconnected", cfg.ConnectionMethod)
+		lib.ForgetCaptures()
+	}
+}
+
+// waitForCamera polls until the camera is connected, or disconnected if
+// connected is false. It returns false if ctx is cancelled first.
+func waitForCamera(ctx context.Context, connected bool) bool {
+	for lib.CameraConnected(cfg) != connected {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(connectionPollInterval):
+		}
+	}
+	return ctx.Err() == nil
+}
+
+// newPhotos scans the camera and returns the photos that pass the format
+// filter and haven't been imported yet
+func newPhotos() ([]string, error) {
+	onCamera, err := lib.ScanCamera(cfg)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool)
+	lib.ScanDownloadDir(existing, onCamera, cfg)
+	filter, err := lib.ParseFormatFilter(string(cfg.FormatFilter))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, name := range onCamera {
+		if !existing[name] && filter.Matches(name) {
+			files = append(files, name)
+		}
+	}
+	lib.EmitScan(len(onCamera), len(files))
+	return files, nil
+}
+
+// importNew downloads every photo that hasn't been imported yet. The returned
+// code is non-zero if the import couldn't start.
+func importNew(ctx context.Context, logf lib.LogFunc) (importSummary, int) {
+	files, err := newPhotos()
+	if err != nil {
+		logf(lib.LogError, err.Error())
+		return importSummary{}, exitError
+	}
+	return importFiles(ctx, files, logf)
+}
+
+// importFiles downloads files one after another after checking they fit,
+// reporting overall progress in steps of 10%
+func importFiles(ctx context.Context, files []string, logf lib.LogFunc) (importSummary, int) {
+	summary := importSummary{Files: len(files)}
+	if len(files) == 0 {
+		logf(lib.LogInfo, "No new photos to import")
+		return summary, exitOK
+	}
+
+	var total int64
+	for _, name := range files {
+		total += lib.SourceSize(name, cfg)
+	}
+	if err := lib.EnsureDownloadDir(cfg.DownloadDir); err != nil {
+		logf(lib.LogError, fmt.Sprintf("Couldn't create %s: %v", cfg.DownloadDir, err))
+		return summary, exitError
+	}
+	if free, err := lib.FreeSpace(cfg.DownloadDir); err != nil {
+		logf(lib.LogInfo, fmt.Sprintf("Couldn't check free space in %s: %v", cfg.DownloadDir, err))
+	} else if total > int64(free) {
+		logf(lib.LogError, fmt.Sprintf("Not enough free space in %s: need %s, %s available", cfg.DownloadDir, formatMB(total), formatMB(int64(free))))
+		return summary, exitNoSpace
+	}
+	logf(lib.LogInfo, fmt.Sprintf("Importing %d photos (%s)", len(files), formatMB(total)))
+
+	start := time.Now()
+	var done int64
+	lastStep := int64(0)
+	onProgress := func(n int64) {
+		done += n
+		if total == 0 {
+			return
+		}
+		if step := done * 10 / total; step > lastStep && step < 10 {
+			lastStep = step
+			logf(lib.LogInfo, fmt.Sprintf("Progress: %d%% (%s of %s)", step*10, formatMB(done), formatMB(total)))
+		}
+	}
+
+	var hookFiles []lib.HookFile
+	for i, name := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		logf(lib.LogInfo, fmt.Sprintf("[%d/%d] %s", i+1, len(files), name))
+		dstPath, err := lib.ImportPhoto(ctx, name, cfg, onProgress, logf)
+		if errors.Is(err, lib.ErrCollisionSkipped) {
+			summary.Skipped++
+			summary.Results = append(summary.Results, importResult{Name: name, Skipped: err.Error()})
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				summary.Failed++
+				summary.Results = append(summary.Results, importResult{Name: name, Error: err.Error()})
+			}
+			continue
+		}
+		summary.Imported++
+		summary.Results = append(summary.Results, importResult{Name: name, LocalPath: dstPath})
+		hookFile := lib.NewHookFile(name, dstPath, cfg)
+		summary.Bytes += hookFile.Size
+		hookFiles = append(hookFiles, hookFile)
+	}
+	elapsed := time.Since(start)
+	summary.Seconds = elapsed.Seconds()
+	lib.EmitBatch(summary.Files, summary.Imported, summary.Skipped, summary.Failed, summary.Bytes, elapsed)
+
+	if len(hookFiles) > 0 {
+		lib.LogHook("after_batch", lib.RunAfterBatchHook(hookFiles, cfg), logf)
+	}
+	logf(lib.LogInfo, fmt.Sprintf("Imported %d of %d photos (%s) in %.1f seconds, %d skipped, %d failed",
+		summary.Imported, summary.Files, formatMB(summary.Bytes), summary.Seconds, summary.Skipped, summary.Failed))
+	return summary, exitOK
+}
@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// CollisionPolicy decides what happens when a download would land on a local
+// file that is a different photo, e.g. after the camera's counter was reset
+type CollisionPolicy string
+
+const (
+	CollisionSkip      CollisionPolicy = "skip"
+	CollisionRename    CollisionPolicy = "rename"
+	CollisionOverwrite CollisionPolicy = "overwrite"
+)
+
+// ErrCollisionSkipped is returned when the collision policy says to skip a photo
+var ErrCollisionSkipped = errors.New("a different photo with the same name is already downloaded")
+
+// ParseCollisionPolicy checks a collision_policy config value
+func ParseCollisionPolicy(value string) (CollisionPolicy, error) {
+	switch p := CollisionPolicy(strings.ToLower(value)); p {
+	case "":
+		return CollisionRename, nil
+	case CollisionSkip, CollisionRename, CollisionOverwrite:
+		return p, nil
+	default:
+		return CollisionRename, fmt.Errorf("unknown collision policy %q, use skip, rename or overwrite", value)
+	}
+}
+
+// localShot is what was read from a local file, cached until the file changes
+type localShot struct {
+	size        int64
+	modTime     time.Time
+	captureTime string
+}
+
+var (
+	localShotCache   = make(map[string]localShot)
+	localShotCacheMu sync.Mutex
+)
+
+func readLocalShot(localPath string) (localShot, bool) {
+	stat, err := os.Stat(localPath)
+	if err != nil {
+		return localShot{}, false
+	}
+
+	localShotCacheMu.Lock()
+	shot, ok := localShotCache[localPath]
+	localShotCacheMu.Unlock()
+	if ok && shot.size == stat.Size() && shot.modTime.Equal(stat.ModTime()) {
+		return shot, true
+	}
+
+	shot = localShot{size: stat.Size(), modTime: stat.ModTime()}
+	if f, err := os.Open(localPath); err == nil {
+		if x, err := exif.Decode(f); err == nil {
+			if t, err := x.DateTime(); err == nil {
+				shot.captureTime = t.Format("2006-01-02T15:04:05")
+			}
+		}
+		f.Close()
+	}
+
+	localShotCacheMu.Lock()
+	localShotCache[localPath] = shot
+	localShotCacheMu.Unlock()
+	return shot, true
+}
+
+// sameShot reports whether the local file is the camera photo, judged by size
+// and, when both sides know it, capture time
+func sameShot(name, localPath string, cfg Config) bool {
+	shot, ok := readLocalShot(localPath)
+	if !ok {
+		return false
+	}
+	info := lookupCapture(name, cfg)
+	// Without a size from the camera there's nothing to compare against
+	if info.Size > 0 && info.Size != shot.size {
+		return false
+	}
+	if shot.captureTime != "" && !info.Time.IsZero() && shot.captureTime != info.Time.Format("2006-01-02T15:04:05") {
+		return false
+	}
+	return true
+}
+
+// ResolveDestPath returns where a camera photo should be downloaded to. If the
+// path from the path template is taken by a different photo, the collision
+// policy decides whether to skip, pick a new name or overwrite it.
+func ResolveDestPath(name string, cfg Config) (string, error) {
+	dstPath := DestPath(name, cfg)
+	if _, err := os.Stat(dstPath); err != nil || sameShot(name, dstPath, cfg) {
+		return dstPath, nil
+	}
+
+	policy, _ := ParseCollisionPolicy(string(cfg.CollisionPolicy))
+	switch policy {
+	case CollisionSkip:
+		return "", ErrCollisionSkipped
+	case CollisionOverwrite:
+		return dstPath, nil
+	default:
+		return uniquePath(dstPath)
+	}
+}
+
+// uniquePath adds a numeric suffix, e.g. R0000001-1.JPG, until the name is free
+func uniquePath(path string) (string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; i < 10000; i++ {
+		candidate := fmt.Sprintf("%s-%d%s", base, i, ext)
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("couldn't find a free name for %s", path)
+}
@@ -1,27 +1,57 @@
 package lib
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 )
 
 // Const for mocking wifi responses in an effort to ease development
 const mock = false
 
-var configFileRelativePath = filepath.Join(".config", "grsync-tui.json")
+const configFileName = "grsync-tui.json"
+
+// configFileOverride is used instead of the default config file when set
+var configFileOverride string
+
+// ErrConfigMissing is returned when the config file set with SetConfigFile
+// doesn't exist. Only the default config file is created on first run.
+var ErrConfigMissing = errors.New("config file doesn't exist")
 
 type Config struct {
-	Mock             bool             `json:"-"` // for testing purposes, not actually in the config file
-	ConnectionMethod ConnectionMethod `json:"connection_method"`
-	DownloadDir      string           `json:"download_dir"`
-	UsbSettings      UsbSettings      `json:"usb"`
+	Mock             bool               `json:"-"` // for testing purposes, not actually in the config file
+	ConnectionMethod ConnectionMethod   `json:"connection_method"`
+	DownloadDir      string             `json:"download_dir"`
+	PathTemplate     string             `json:"path_template"`
+	FormatFilter     FormatFilter       `json:"format_filter"`
+	CollisionPolicy  CollisionPolicy    `json:"collision_policy"`
+	XmpSidecar       bool               `json:"xmp_sidecar"`
+	UsbSettings      UsbSettings        `json:"usb"`
+	WifiSettings     WifiSettings       `json:"wifi"`
+	Retry            RetrySettings      `json:"retry"`
+	Hooks            HookSettings       `json:"hooks"`
+	DefaultProfile   string             `json:"default_profile,omitempty"` // profile used when --profile isn't given
+	Profiles         map[string]Profile `json:"profiles,omitempty"`
+	ActiveProfile    string             `json:"-"` // profile applied by WithProfile
 }
 
 type UsbSettings struct {
-	CameraDir string `json:"camera_dir"`
+	CameraDir      string `json:"camera_dir"`
+	VerifyChecksum bool   `json:"verify_checksum"` // compare SHA-256 of the copy against the card
+}
+
+type WifiSettings struct {
+	Host string `json:"host"` // camera base URL, defaults to http://192.168.0.1/
 }
 
 func defaultConfig() Config {
@@ -29,18 +59,28 @@ func defaultConfig() Config {
 	cfg := Config{
 		ConnectionMethod: ConnectionMethodWiFi, // default to wifi for now, in the future, we should have a splash screen to choose connection method
 		DownloadDir:      filepath.Join(exeDir, "download"),
+		PathTemplate:     DefaultPathTemplate,
+		FormatFilter:     FormatBoth,
+		CollisionPolicy:  CollisionRename,
 		Mock:             mock, // for testing purposes, not actually in the config file
 		UsbSettings: UsbSettings{
 			CameraDir: filepath.Join(exeDir, "camera"),
 		},
-	}
-	err := saveConfig(cfg)
-	if err != nil {
-		fmt.Errorf("unable to save default config: %v", err)
+		WifiSettings: WifiSettings{
+			Host: DefaultGRHost,
+		},
+		Retry: defaultRetrySettings(),
+		Hooks: defaultHookSettings(),
 	}
 	return cfg
 }
 
+// DefaultConfig is the config used when there is no config file. It isn't
+// saved anywhere.
+func DefaultConfig() Config {
+	return defaultConfig()
+}
+
 type ConnectionMethod string
 
 const (
@@ -48,39 +88,357 @@ const (
 	ConnectionMethodWiFi ConnectionMethod = "wifi"
 )
 
+// homeDir prefers $HOME over the user database, which has no entry for the
+// user in some containers
+func homeDir() string {
+	if home, err := os.UserHomeDir(); err == nil {
+		return home
+	}
+	if usr, err := user.Current(); err == nil {
+		return usr.HomeDir
+	}
+	return "."
+}
+
+// configDir is $XDG_CONFIG_HOME, or ~/.config when it isn't set
+func configDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(homeDir(), ".config")
+}
+
 func configFilePath() string {
-	usr, _ := user.Current()
-	return filepath.Join(usr.HomeDir, configFileRelativePath)
+	if configFileOverride != "" {
+		return configFileOverride
+	}
+	path := filepath.Join(configDir(), configFileName)
+	// Keep using a config from before XDG_CONFIG_HOME was honoured
+	legacy := filepath.Join(homeDir(), ".config", configFileName)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(legacy); err == nil {
+			return legacy
+		}
+	}
+	return path
+}
+
+// SetConfigFile reads and writes the config from path instead of the default
+// location. The import manifest is kept next to it. The file has to exist.
+func SetConfigFile(path string) {
+	configFileOverride = path
+}
+
+// DisplayConfigPath is the config file location shown to the user
+func DisplayConfigPath() string {
+	path := configFilePath()
+	if home := homeDir(); strings.HasPrefix(path, home+string(filepath.Separator)) {
+		return "~" + strings.TrimPrefix(path, home)
+	}
+	return path
 }
 
+// ConfigError lists what is wrong with a config
+type ConfigError struct {
+	Path     string
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("problems with config file %s:\n  %s", e.Path, strings.Join(e.Problems, "\n  "))
+}
+
+// LoadConfig reads the config file, writing the defaults to it on first run
+// unless it was set with SetConfigFile.
+// A config file that can't be read or parsed is never rewritten; LoadConfig
+// returns the defaults along with a *ConfigError saying what's wrong with it.
 func LoadConfig() (Config, error) {
 	path := configFilePath()
 	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if configFileOverride != "" {
+			return defaultConfig(), fmt.Errorf("%s: %w", path, ErrConfigMissing)
+		}
+		cfg := defaultConfig()
+		if err := saveConfig(cfg); err != nil {
+			return cfg, fmt.Errorf("unable to save default config: %w", err)
+		}
+		return cfg, nil
+	}
 	if err != nil {
-		// File doesn't exist, return default config
-		return defaultConfig(), nil
+		return defaultConfig(), &ConfigError{Path: path, Problems: []string{err.Error()}}
 	}
 	defer f.Close()
-	var cfg Config
-	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
-		return defaultConfig(), nil
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return defaultConfig(), &ConfigError{Path: path, Problems: []string{err.Error()}}
+	}
+
+	if problems := checkConfigJSON(data); len(problems) > 0 {
+		return defaultConfig(), &ConfigError{Path: path, Problems: problems}
+	}
+	// Settings missing from older config files keep their defaults
+	cfg := Config{Retry: defaultRetrySettings(), Hooks: defaultHookSettings()}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return defaultConfig(), &ConfigError{Path: path, Problems: []string{err.Error()}}
 	}
 	cfg.Mock = mock
 	return cfg, nil
 }
 
+// checkConfigJSON lists every setting in a config file that is unknown or has
+// a value of the wrong type, rather than stopping at the first one like the
+// JSON decoder does
+func checkConfigJSON(data []byte) []string {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return []string{"the file is empty"}
+	}
+	var syntax interface{}
+	if err := json.Unmarshal(data, &syntax); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return []string{fmt.Sprintf("invalid JSON at byte %d: %v", syntaxErr.Offset, err)}
+		}
+		return []string{fmt.Sprintf("invalid JSON: %v", err)}
+	}
+	return checkSetting(data, reflect.TypeOf(Config{}), "")
+}
+
+// checkSetting checks the JSON value of the setting called name against t,
+// descending into objects
+func checkSetting(data json.RawMessage, t reflect.Type, name string) []string {
+	if string(bytes.TrimSpace(data)) == "null" {
+		return nil
+	}
+	var problems []string
+	switch t.Kind() {
+	case reflect.Struct:
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return []string{wrongType(name, t)}
+		}
+		known := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			if tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; tag != "" && tag != "-" {
+				known[tag] = t.Field(i).Type
+			}
+		}
+		for _, key := range sortedKeys(fields) {
+			fieldType, ok := known[key]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("unknown setting %q", settingName(name, key)))
+				continue
+			}
+			problems = append(problems, checkSetting(fields[key], fieldType, settingName(name, key))...)
+		}
+	case reflect.Map:
+		var entries map[string]json.RawMessage
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return []string{wrongType(name, t)}
+		}
+		for _, key := range sortedKeys(entries) {
+			problems = append(problems, checkSetting(entries[key], t.Elem(), settingName(name, key))...)
+		}
+	default:
+		if err := json.Unmarshal(data, reflect.New(t).Interface()); err != nil {
+			return []string{wrongType(name, t)}
+		}
+	}
+	return problems
+}
+
+func settingName(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+func wrongType(name string, t reflect.Type) string {
+	expected := "an object"
+	switch t.Kind() {
+	case reflect.String:
+		expected = "a string"
+	case reflect.Bool:
+		expected = "true or false"
+	case reflect.Int, reflect.Int64:
+		expected = "a whole number"
+	case reflect.Float64:
+		expected = "a number"
+	}
+	if name == "" {
+		return "the config must be " + expected
+	}
+	return fmt.Sprintf("%s: expected %s", name, expected)
+}
+
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ValidateConfig checks the settings of cfg and that its directories can be
+// used. It returns a *ConfigError listing every problem, or nil.
+func ValidateConfig(cfg Config) error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch cfg.ConnectionMethod {
+	case ConnectionMethodUSB:
+		if cfg.UsbSettings.CameraDir == "" {
+			add("usb.camera_dir: not set")
+		} else if info, err := os.Stat(cfg.UsbSettings.CameraDir); err == nil && !info.IsDir() {
+			// A missing camera directory just means the camera isn't mounted yet
+			add("usb.camera_dir: %s is not a directory", cfg.UsbSettings.CameraDir)
+		}
+	case ConnectionMethodWiFi:
+		if cfg.WifiSettings.Host != "" {
+			u, err := url.Parse(cfg.WifiSettings.Host)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				add("wifi.host: %q is not an http:// URL", cfg.WifiSettings.Host)
+			}
+		}
+	default:
+		add("connection_method: %q is not supported, use \"usb\" or \"wifi\"", cfg.ConnectionMethod)
+	}
+
+	for _, name := range cfg.ProfileNames() {
+		switch method := cfg.Profiles[name].ConnectionMethod; method {
+		case "", ConnectionMethodUSB, ConnectionMethodWiFi:
+		default:
+			add("profiles.%s.connection_method: %q is not supported, use \"usb\" or \"wifi\"", name, method)
+		}
+	}
+	if _, ok := cfg.Profiles[cfg.DefaultProfile]; cfg.DefaultProfile != "" && !ok {
+		add("default_profile: there is no profile called %q", cfg.DefaultProfile)
+	}
+
+	if cfg.DownloadDir == "" {
+		add("download_dir: not set")
+	} else if err := checkWritableDir(cfg.DownloadDir); err != nil {
+		add("download_dir: %v", err)
+	}
+	if err := checkPathTemplate(cfg.PathTemplate); err != nil {
+		add("path_template: %v", err)
+	}
+	if _, err := ParseFormatFilter(string(cfg.FormatFilter)); err != nil {
+		add("format_filter: %v", err)
+	}
+	if _, err := ParseCollisionPolicy(string(cfg.CollisionPolicy)); err != nil {
+		add("collision_policy: %v", err)
+	}
+	if cfg.Retry.Attempts < 0 {
+		add("retry.attempts: can't be negative")
+	}
+	if cfg.Retry.BackoffSeconds < 0 {
+		add("retry.backoff_seconds: can't be negative")
+	}
+	if cfg.Hooks.TimeoutSeconds < 0 {
+		add("hooks.timeout_seconds: can't be negative")
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Path: configFilePath(), Problems: problems}
+	}
+	return nil
+}
+
+// checkWritableDir makes sure dir is a directory we can write to, or that it
+// can be created if it doesn't exist yet
+func checkWritableDir(dir string) error {
+	info, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		// Look for the closest parent that exists, it's where dir will be created
+		parent := filepath.Dir(dir)
+		for parent != filepath.Dir(parent) {
+			if _, err := os.Stat(parent); err == nil {
+				break
+			}
+			parent = filepath.Dir(parent)
+		}
+		if err := checkWritableDir(parent); err != nil {
+			return fmt.Errorf("%s can't be created: %v", dir, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, ".grsync-tui-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable", dir)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// ResetConfig moves the config file aside and writes the defaults in its
+// place. It returns the defaults and where the old file was moved to.
+func ResetConfig() (Config, string, error) {
+	cfg := defaultConfig()
+	backup, err := ReplaceConfig(cfg)
+	return cfg, backup, err
+}
+
+// ReplaceConfig moves the config file aside and writes cfg in its place, e.g.
+// when saving over a file that couldn't be read. The old file is named after
+// the current time so earlier backups are kept, and ReplaceConfig returns
+// where it was moved to.
+func ReplaceConfig(cfg Config) (string, error) {
+	path := configFilePath()
+	backup := fmt.Sprintf("%s.%s.bak", path, time.Now().Format("20060102-150405"))
+	if _, err := os.Stat(backup); err == nil {
+		return "", fmt.Errorf("%s already exists", backup)
+	}
+	if err := os.Rename(path, backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	return backup, saveConfig(cfg)
+}
+
+// SaveConfig writes cfg to the config file, e.g. after it was edited in the
+// settings screen
+func SaveConfig(cfg Config) error {
+	return saveConfig(cfg)
+}
+
+// saveConfig writes cfg to a temp file first, so an interrupted write can't
+// leave a truncated config behind
 func saveConfig(cfg Config) error {
 	path := configFilePath()
-	os.MkdirAll(filepath.Dir(path), 0700)
-	f, err := os.Create(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmpPath := path + PartSuffix
+	f, err := os.Create(tmpPath)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
 	jsonEncoder := json.NewEncoder(f)
 	jsonEncoder.SetIndent("", "  ")
-	return jsonEncoder.Encode(cfg)
+	if err := jsonEncoder.Encode(cfg); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
 }
 
 func EnsureDownloadDir(dir string) error {
@@ -0,0 +1,230 @@
+package lib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckPathTemplate(t *testing.T) {
+	tests := []struct {
+		tmpl    string
+		wantErr string
+	}{
+		{"", ""},
+		{DefaultPathTemplate, ""},
+		{"{date:2006/01/02}/{name}.{ext}", ""},
+		{"{model}/{camera_dir}/{file}", ""},
+		{"photos/{file}", ""},
+		{"{file}..{ext}", ""},
+		{"{foo}/{file}", "unknown token {foo}"},
+		{"{date:2006}/{Model}", ""}, // only lower case names are tokens
+		{"/photos/{file}", "must be relative"},
+		{"../{file}", "must stay inside"},
+		{"{camera_dir}/../../{file}", "must stay inside"},
+		{`..\{file}`, "must stay inside"},
+	}
+	for _, tt := range tests {
+		err := checkPathTemplate(tt.tmpl)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("checkPathTemplate(%q) = %v, want no error", tt.tmpl, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("checkPathTemplate(%q) = %v, want error containing %q", tt.tmpl, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	valid := func() Config {
+		return Config{
+			ConnectionMethod: ConnectionMethodUSB,
+			DownloadDir:      filepath.Join(dir, "download"),
+			UsbSettings:      UsbSettings{CameraDir: filepath.Join(dir, "camera")},
+			Retry:            defaultRetrySettings(),
+			Hooks:            defaultHookSettings(),
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change func(*Config)
+		want   []string // start of each problem, in order
+	}{
+		{"valid", func(c *Config) {}, nil},
+		{"download dir exists", func(c *Config) { c.DownloadDir = dir }, nil},
+		{"nested download dir to create", func(c *Config) { c.DownloadDir = filepath.Join(dir, "a", "b", "c") }, nil},
+		{"wifi with default host", func(c *Config) { c.ConnectionMethod = ConnectionMethodWiFi }, nil},
+		{"wifi with host", func(c *Config) {
+			c.ConnectionMethod = ConnectionMethodWiFi
+			c.WifiSettings.Host = "http://127.0.0.1:8080/"
+		}, nil},
+		{"empty filter and policy", func(c *Config) { c.FormatFilter, c.CollisionPolicy = "", "" }, nil},
+		{"upper case filter", func(c *Config) { c.FormatFilter = "DNG" }, nil},
+		{"unknown method", func(c *Config) { c.ConnectionMethod = "bluetooth" }, []string{"connection_method:"}},
+		{"no method", func(c *Config) { c.ConnectionMethod = "" }, []string{"connection_method:"}},
+		{"no camera dir", func(c *Config) { c.UsbSettings.CameraDir = "" }, []string{"usb.camera_dir: not set"}},
+		{"camera dir is a file", func(c *Config) { c.UsbSettings.CameraDir = file }, []string{"usb.camera_dir:"}},
+		{"camera dir only checked over usb", func(c *Config) {
+			c.ConnectionMethod = ConnectionMethodWiFi
+			c.UsbSettings.CameraDir = file
+		}, nil},
+		{"host without scheme", func(c *Config) {
+			c.ConnectionMethod = ConnectionMethodWiFi
+			c.WifiSettings.Host = "192.168.0.1"
+		}, []string{"wifi.host:"}},
+		{"ftp host", func(c *Config) {
+			c.ConnectionMethod = ConnectionMethodWiFi
+			c.WifiSettings.Host = "ftp://192.168.0.1/"
+		}, []string{"wifi.host:"}},
+		{"no download dir", func(c *Config) { c.DownloadDir = "" }, []string{"download_dir: not set"}},
+		{"download dir is a file", func(c *Config) { c.DownloadDir = file }, []string{"download_dir:"}},
+		{"download dir below a file", func(c *Config) { c.DownloadDir = filepath.Join(file, "photos") }, []string{"download_dir:"}},
+		{"bad template", func(c *Config) { c.PathTemplate = "../{file}" }, []string{"path_template:"}},
+		{"bad filter", func(c *Config) { c.FormatFilter = "raw" }, []string{"format_filter:"}},
+		{"bad policy", func(c *Config) { c.CollisionPolicy = "merge" }, []string{"collision_policy:"}},
+		{"negative numbers", func(c *Config) {
+			c.Retry = RetrySettings{Attempts: -1, BackoffSeconds: -1}
+			c.Hooks.TimeoutSeconds = -1
+		}, []string{"retry.attempts:", "retry.backoff_seconds:", "hooks.timeout_seconds:"}},
+		{"every problem is listed", func(c *Config) {
+			c.ConnectionMethod = "bt"
+			c.DownloadDir = ""
+			c.FormatFilter = "raw"
+		}, []string{"connection_method:", "download_dir:", "format_filter:"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.change(&cfg)
+			err := ValidateConfig(cfg)
+			var problems []string
+			var cfgErr *ConfigError
+			if errors.As(err, &cfgErr) {
+				problems = cfgErr.Problems
+			} else if err != nil {
+				t.Fatalf("got %T, want *ConfigError", err)
+			}
+			if len(problems) != len(tt.want) {
+				t.Fatalf("got problems %q, want %d starting with %q", problems, len(tt.want), tt.want)
+			}
+			for i, want := range tt.want {
+				if !strings.HasPrefix(problems[i], want) {
+					t.Errorf("problem %d = %q, want it to start with %q", i, problems[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckConfigJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want []string
+	}{
+		{"valid", `{"connection_method": "usb", "usb": {"camera_dir": "/mnt"}, "retry": {"attempts": 2, "backoff_seconds": 0.5}}`, nil},
+		{"older file without sections", `{"connection_method": "wifi"}`, nil},
+		{"null section", `{"hooks": null}`, nil},
+		{"profiles", `{"profiles": {"gr3": {"connection_method": "wifi", "host": "http://10.0.0.1"}}, "default_profile": "gr3"}`, nil},
+		{"empty", "  \n", []string{"the file is empty"}},
+		{"syntax error", `{"connection_method": "usb",}`, []string{"invalid JSON at byte"}},
+		{"not an object", `["usb"]`, []string{"the config must be an object"}},
+		{"all problems", `{"connection_method": 1, "downlaod_dir": "x", "usb": {"camera_dir": true, "foo": 1}, "retry": {"attempts": 1.5}}`, []string{
+			`connection_method: expected a string`,
+			`unknown setting "downlaod_dir"`,
+			`retry.attempts: expected a whole number`,
+			`usb.camera_dir: expected a string`,
+			`unknown setting "usb.foo"`,
+		}},
+		{"section of the wrong type", `{"hooks": "echo hi", "xmp_sidecar": "yes"}`, []string{
+			`hooks: expected an object`,
+			`xmp_sidecar: expected true or false`,
+		}},
+		{"bad profile", `{"profiles": {"gr3": {"host": 1, "camera": "/mnt"}, "gr3x": "usb"}}`, []string{
+			`unknown setting "profiles.gr3.camera"`,
+			`profiles.gr3.host: expected a string`,
+			`profiles.gr3x: expected an object`,
+		}},
+		{"runtime only fields aren't settings", `{"Mock": true}`, []string{`unknown setting "Mock"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkConfigJSON([]byte(tt.json))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			for i := range tt.want {
+				if !strings.HasPrefix(got[i], tt.want[i]) {
+					t.Errorf("problem %d = %q, want it to start with %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigKeepsBrokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grsync-tui.json")
+	broken := []byte(`{"connection_method": "usb", "downlaod_dir": "/photos"}`)
+	if err := os.WriteFile(path, broken, 0644); err != nil {
+		t.Fatal(err)
+	}
+	SetConfigFile(path)
+	defer SetConfigFile("")
+
+	cfg, err := LoadConfig()
+	var cfgErr *ConfigError
+	if !errors.As(err, &cfgErr) {
+		t.Fatalf("LoadConfig() error = %v, want *ConfigError", err)
+	}
+	if !reflect.DeepEqual(cfg, defaultConfig()) {
+		t.Errorf("LoadConfig() didn't return the defaults for a broken file")
+	}
+	if data, _ := os.ReadFile(path); string(data) != string(broken) {
+		t.Errorf("broken config was rewritten to %s", data)
+	}
+}
+
+func TestLoadConfigMissingOverride(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.json")
+	SetConfigFile(path)
+	defer SetConfigFile("")
+
+	if _, err := LoadConfig(); !errors.Is(err, ErrConfigMissing) {
+		t.Errorf("LoadConfig() error = %v, want ErrConfigMissing", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadConfig() created %s", path)
+	}
+}
+
+func TestReplaceConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grsync-tui.json")
+	broken := []byte(`{"connection_method": 1}`)
+	if err := os.WriteFile(path, broken, 0644); err != nil {
+		t.Fatal(err)
+	}
+	SetConfigFile(path)
+	defer SetConfigFile("")
+
+	cfg := defaultConfig()
+	cfg.DownloadDir = "/photos"
+	backup, err := ReplaceConfig(cfg)
+	if err != nil {
+		t.Fatalf("ReplaceConfig() error = %v", err)
+	}
+	if data, _ := os.ReadFile(backup); string(data) != string(broken) {
+		t.Errorf("backup %s = %s, want the old file", backup, data)
+	}
+	if got, err := LoadConfig(); err != nil || got.DownloadDir != "/photos" {
+		t.Errorf("LoadConfig() after ReplaceConfig = %+v, %v", got, err)
+	}
+}
@@ -8,45 +8,60 @@ import (
 	"time"
 )
 
+// How long a single WiFi connection check may take
+const connectionCheckTimeout = 3 * time.Second
+
+// CameraConnected checks once whether the camera can be reached
+func CameraConnected(cfg Config) bool {
+	switch cfg.ConnectionMethod {
+	case ConnectionMethodUSB:
+		_, err := os.Stat(cfg.UsbSettings.CameraDir)
+		return err == nil
+	case ConnectionMethodWiFi:
+		if cfg.Mock {
+			return true
+		}
+		client := http.Client{Timeout: connectionCheckTimeout}
+		resp, err := client.Get(GRPhotoListURL())
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	default:
+		return false
+	}
+}
+
 func WaitForConnection(cfg Config) {
 	fmt.Println("Waiting for connection to camera via", cfg.ConnectionMethod, "...")
+	EmitConnection("waiting", cfg.ConnectionMethod)
 	switch cfg.ConnectionMethod {
 	case ConnectionMethodUSB:
 		// ensure the camera directory exists
 		fmt.Println("Camera directory is configured as:", cfg.UsbSettings.CameraDir)
 		fmt.Println("Repeatedly checking for existing camera directory")
 
-		// wait infinitely until we see the directory exists
-		for {
-			if _, err := os.Stat(cfg.UsbSettings.CameraDir); err == nil {
-				break
-			}
-			time.Sleep(1 * time.Second) // wait 1 second before checking again
-		}
-
 	case ConnectionMethodWiFi:
 		// ensure the camera is connected via Wifi
-		fmt.Println("Repeatedly checking connection to", GRHost)
+		fmt.Println("Repeatedly checking connection to", GRHost())
 		fmt.Println("Ensure your device is connected to the camera's WiFi network.")
 
 		if cfg.Mock {
 			fmt.Println("Mock mode enabled, simulating connection to camera.")
 			fmt.Println("Mock connection established.")
+			EmitConnection("connected", cfg.ConnectionMethod)
 			return
 		}
-
-		// wait infinitely until we can reach the camera
-		for {
-			resp, err := http.Get(GRPhotoListURL())
-			if err == nil && resp.StatusCode == http.StatusOK {
-				resp.Body.Close()
-				break
-			}
-			time.Sleep(1 * time.Second) // wait 1 second before checking again
-		}
 	default:
 		fmt.Println("Unsupported connection method:", cfg.ConnectionMethod)
 		syscall.Exit(1)
 	}
-	fmt.Println("Connection established, starting TUI.")
+
+	// wait infinitely until we can reach the camera
+	for !CameraConnected(cfg) {
+		time.Sleep(1 * time.Second) // wait 1 second before checking again
+	}
+	fmt.Println("Connection established.")
+	EmitConnection("connected", cfg.ConnectionMethod)
 }
@@ -12,16 +12,30 @@ func SetupControls(
 	app *tview.Application,
 	photoListBox *tview.List,
 	currentItem *int,
-	photos []string,
+	currentPhoto func() string,
 	pages *tview.Pages,
 	logBox *tview.TextView,
 	setAppFocus func(t *tview.TextView, l *tview.List),
 	itemIsSelected func(int) bool,
 	toggleSelection func(int),
 	downloadSelected func(),
+	moveSelected func(),
+	deleteSelected func(),
+	retryFailed func(),
 	selectAll func(),
 	deselectAll func(),
+	toggleFormatFilter func(),
+	setRating func(int),
+	editKeywords func(),
+	chooseProfile func(),
+	editSettings func(),
 	renderPreviewModal func(string) tview.Primitive,
+	queueBox *tview.Table,
+	togglePause func(),
+	cancelQueue func(),
+	moveQueueItem func(Direction),
+	cancelQueueItem func(),
+	clearFinished func(),
 ) {
 	photoListBox.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 		switch event.Key() {
@@ -32,8 +46,31 @@ func SetupControls(
 		return event
 	})
 
+	setupQueueControls(queueBox, photoListBox, setAppFocus, togglePause, cancelQueue, moveQueueItem, cancelQueueItem, clearFinished)
+
 	// Setup keymap
 	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		// Let text inputs have every key
+		if _, ok := app.GetFocus().(*tview.InputField); ok {
+			return event
+		}
+
+		// So does the settings form, which needs Tab to move between fields
+		if page, _ := pages.GetFrontPage(); page == "settings" {
+			if event.Key() == tcell.KeyCtrlQ {
+				app.Stop()
+			}
+			return event
+		}
+
+		// The queue panel handles its own keys while focused
+		if app.GetFocus() == queueBox {
+			if event.Key() == tcell.KeyCtrlQ {
+				app.Stop()
+			}
+			return event
+		}
+
 		switch key := event.Key(); key {
 
 		// up: move up one item
@@ -70,13 +107,48 @@ func SetupControls(
 			case 'd':
 				downloadSelected()
 
+			// m: move selected photos off the card (USB only)
+			case 'm':
+				moveSelected()
+
+			// Shift + d: delete selected photos from the camera (WiFi only)
+			case 'D':
+				deleteSelected()
+
+			// r: retry photos that failed in the last batch
+			case 'r':
+				retryFailed()
+
 			// p: show preview modal
 			case 'p':
-				if len(photos) > 0 && *currentItem >= 0 && *currentItem < len(photos) {
-					name := photos[*currentItem]
+				if name := currentPhoto(); name != "" {
 					pages.AddPage("preview", renderPreviewModal(name), true, true)
 				}
 
+			// f: switch between JPEG + DNG, JPEG only and DNG only
+			case 'f':
+				toggleFormatFilter()
+
+			// 0-5: rate selected photos, 0 clears the rating
+			case '0', '1', '2', '3', '4', '5':
+				setRating(int(event.Rune() - '0'))
+
+			// t: edit keywords of selected photos
+			case 't':
+				editKeywords()
+				// Don't let the key reach the input that just got focus
+				return nil
+
+			// c: switch camera profile
+			case 'c':
+				chooseProfile()
+				return nil
+
+			// s: edit settings
+			case 's':
+				editSettings()
+				return nil
+
 			// Shift + j: expand selection down one
 			case 'J':
 				expandSelection(itemIsSelected, toggleSelection, photoListBox, currentItem, Down)
@@ -85,6 +157,14 @@ func SetupControls(
 			case 'K':
 				expandSelection(itemIsSelected, toggleSelection, photoListBox, currentItem, Up)
 
+			// Shift + p: pause or resume the download queue
+			case 'P':
+				togglePause()
+
+			// Shift + x: cancel all queued downloads
+			case 'X':
+				cancelQueue()
+
 			// h or ? for help
 			case 'h', '?':
 				pages.AddPage("help", renderHelpModal(pages), true, true)
@@ -102,6 +182,11 @@ func SetupControls(
 		case tcell.KeyCtrlQ:
 			app.Stop()
 
+		// Tab: switch to the download queue
+		case tcell.KeyTab:
+			app.SetFocus(queueBox)
+			return nil
+
 		// Home / End: Scroll to beginning or end of log
 		case tcell.KeyHome:
 			scrollPhotoList(Up, photoListBox, setAppFocus)
@@ -118,6 +203,71 @@ func SetupControls(
 	})
 }
 
+// setupQueueControls sets up the keybindings used while the queue panel is focused
+func setupQueueControls(
+	queueBox *tview.Table,
+	photoListBox *tview.List,
+	setAppFocus func(t *tview.TextView, l *tview.List),
+	togglePause func(),
+	cancelQueue func(),
+	moveQueueItem func(Direction),
+	cancelQueueItem func(),
+	clearFinished func(),
+) {
+	queueBox.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+
+		// Tab / Esc: back to the photo list
+		case tcell.KeyTab, tcell.KeyEscape:
+			setAppFocus(nil, photoListBox)
+			return nil
+
+		// Shift + Up / Down: move the item within the queue
+		case tcell.KeyUp:
+			if event.Modifiers()&tcell.ModShift != 0 {
+				moveQueueItem(Up)
+				return nil
+			}
+		case tcell.KeyDown:
+			if event.Modifiers()&tcell.ModShift != 0 {
+				moveQueueItem(Down)
+				return nil
+			}
+
+		case tcell.KeyRune:
+			switch event.Rune() {
+			case 'K':
+				moveQueueItem(Up)
+				return nil
+			case 'J':
+				moveQueueItem(Down)
+				return nil
+
+			// x: cancel the highlighted item
+			case 'x':
+				cancelQueueItem()
+				return nil
+
+			// Shift + x: cancel everything
+			case 'X':
+				cancelQueue()
+				return nil
+
+			// c: clear finished items
+			case 'c':
+				clearFinished()
+				return nil
+
+			// Shift + p: pause or resume
+			case 'P':
+				togglePause()
+				return nil
+			}
+		}
+		return event
+	})
+}
+
 func expandSelection(itemIsSelected func(int) bool, toggleSelection func(int), photoListBox *tview.List, currentItem *int, direction Direction) {
 	if photoListBox.GetItemCount() == 0 {
 		return
@@ -159,7 +309,22 @@ func renderHelpModal(pages *tview.Pages) tview.Primitive {
 		{"Ctrl+A", "Select all items"},
 		{"Ctrl+D", "Deselect all items"},
 		{"d", "Download selected photos"},
+		{"m", "Move selected photos off card (USB)"},
+		{"Shift+D", "Delete selected photos from camera (WiFi)"},
+		{"r", "Retry the last batch's failures"},
+		{"Shift+P", "Pause or resume the download queue"},
+		{"Shift+X", "Cancel all queued downloads"},
+		{"Tab", "Switch between photo list and queue"},
+		{"Queue: Shift+Up / K", "Move queued photo up"},
+		{"Queue: Shift+Down / J", "Move queued photo down"},
+		{"Queue: x", "Cancel highlighted download"},
+		{"Queue: c", "Clear finished downloads"},
 		{"p", "Show image preview (ascii)"},
+		{"f", "Cycle format filter (JPEG + DNG / JPEG / DNG)"},
+		{"0-5", "Rate selected photos (0 clears)"},
+		{"t", "Edit keywords of selected photos"},
+		{"c", "Switch camera profile"},
+		{"s", "Edit settings"},
 		{"PgUp / PgDn", "Scroll log up or down"},
 		{"Home / End", "Scroll photo list to beginning or end"},
 		{"h / ?", "Show this help"},
@@ -206,7 +371,7 @@ func renderHelpModal(pages *tview.Pages) tview.Primitive {
 	// Add a row that shows where the configuration file is located
 	rowIdx := len(keybinds) + 2
 	table.SetCell(rowIdx, 0, tview.NewTableCell("[yellow::b]Config file"))
-	table.SetCell(rowIdx, 1, tview.NewTableCell(fmt.Sprintf("[white]~/%s", configFileRelativePath)))
+	table.SetCell(rowIdx, 1, tview.NewTableCell("[white]"+DisplayConfigPath()))
 
 	table.SetBorder(true).SetTitle("Help / Keybindings")
 
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !netbsd && !solaris && !openbsd && !windows
+
+package lib
+
+import "errors"
+
+// FreeSpace isn't available on this platform
+func FreeSpace(dir string) (uint64, error) {
+	return 0, errors.New("free space check isn't supported on this platform")
+}
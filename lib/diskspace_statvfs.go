@@ -0,0 +1,14 @@
+//go:build netbsd || solaris
+
+package lib
+
+import "golang.org/x/sys/unix"
+
+// FreeSpace returns the bytes available to us on the filesystem holding dir
+func FreeSpace(dir string) (uint64, error) {
+	var stat unix.Statvfs_t
+	if err := unix.Statvfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Frsize), nil
+}
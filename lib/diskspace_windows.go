@@ -0,0 +1,18 @@
+//go:build windows
+
+package lib
+
+import "golang.org/x/sys/windows"
+
+// FreeSpace returns the bytes available to us on the volume holding dir
+func FreeSpace(dir string) (uint64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &available, &total, &free); err != nil {
+		return 0, err
+	}
+	return available, nil
+}
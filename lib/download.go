@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PartSuffix is appended to files that are still being downloaded
+const PartSuffix = ".part"
+
+func isPartFile(name string) bool {
+	return strings.HasSuffix(name, PartSuffix)
+}
+
+// SweepStaleParts removes partial downloads under root that haven't been
+// touched for maxAge. Recent ones are kept so WiFi downloads can resume.
+func SweepStaleParts(root string, maxAge time.Duration) int {
+	removed := 0
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !isPartFile(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			return nil
+		}
+		if os.Remove(path) == nil {
+			removed++
+		}
+		return nil
+	})
+	return removed
+}
+
+// contextReader stops reading as soon as its context is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// ProgressFunc is called with the number of bytes transferred since the last call
+type ProgressFunc func(n int64)
+
+// progressReader reports every read to onProgress
+type progressReader struct {
+	r          io.Reader
+	onProgress ProgressFunc
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 && p.onProgress != nil {
+		p.onProgress(int64(n))
+	}
+	return n, err
+}
+
+// DownloadWiFi fetches a photo from the camera into dstPath. Data is written to
+// dstPath + PartSuffix first, and an existing partial file is resumed with an
+// HTTP Range request. The file is only moved to dstPath once its size matches
+// the size reported by the camera. Cancelling ctx aborts the transfer and
+// removes the partial file. Progress, including any resumed bytes, is reported
+// to onProgress.
+func DownloadWiFi(ctx context.Context, name, dstPath string, cfg Config, onProgress ProgressFunc) error {
+	info, err := wifiGetPhotoInfo(name, cfg.Mock)
+	if err != nil {
+		return fmt.Errorf("couldn't get photo info for %s: %w", name, err)
+	}
+	if info.Size <= 0 {
+		return fmt.Errorf("camera did not report a size for %s", name)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return fmt.Errorf("couldn't create destination directory: %v", err)
+	}
+
+	partPath := dstPath + PartSuffix
+	var offset int64
+	if stat, err := os.Stat(partPath); err == nil {
+		offset = stat.Size()
+	}
+
+	// A partial file larger than the photo can't be resumed, start over
+	if offset > info.Size {
+		if err := os.Remove(partPath); err != nil {
+			return err
+		}
+		offset = 0
+	}
+
+	if offset > 0 && onProgress != nil {
+		onProgress(offset)
+	}
+
+	if offset < info.Size {
+		if err := fetchRange(ctx, name, partPath, offset, onProgress); err != nil {
+			if ctx.Err() != nil {
+				os.Remove(partPath)
+				return ctx.Err()
+			}
+			return err
+		}
+	}
+
+	stat, err := os.Stat(partPath)
+	if err != nil {
+		return err
+	}
+	if stat.Size() != info.Size {
+		return fmt.Errorf("incomplete download: got %d of %d bytes", stat.Size(), info.Size)
+	}
+
+	return os.Rename(partPath, dstPath)
+}
+
+// fetchRange requests the photo starting at offset and writes the response
+// into partPath, appending if the camera honoured the range.
+func fetchRange(ctx context.Context, name, partPath string, offset int64, onProgress ProgressFunc) error {
+	url := fmt.Sprintf("%s/%s", GRPhotoListURL(), name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// Camera ignored the range and sent the whole file
+		flags |= os.O_TRUNC
+		if offset > 0 && onProgress != nil {
+			onProgress(-offset)
+		}
+	default:
+		return &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	out, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, &progressReader{r: resp.Body, onProgress: onProgress})
+	// Whatever was received is flushed so a later resume starts from real data
+	if syncErr := out.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
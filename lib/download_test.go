@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDownloadWiFiResume(t *testing.T) {
+	const photo = "0123456789abcdef"
+	tests := []struct {
+		name        string
+		part        string // partial file left by an earlier try, if any
+		honourRange bool
+		short       bool // the camera stops sending 6 bytes early
+		wantRange   string
+		wantErr     string
+		wantPart    string // what's left in the partial file after an error
+		wantMinimum int64  // most negative progress step, to undo bytes counted twice
+	}{
+		{name: "fresh download", honourRange: true},
+		{name: "206 appends to the partial file", part: photo[:8], honourRange: true, wantRange: "bytes=8-"},
+		{name: "200 starts over", part: "0123XXXX", wantRange: "bytes=8-", wantMinimum: -8},
+		{name: "partial file larger than the photo", part: photo + "XXXX", honourRange: true},
+		{name: "short body", short: true, wantErr: "incomplete download", wantPart: photo[:10]},
+		{name: "short body when resuming", part: photo[:4], honourRange: true, short: true, wantRange: "bytes=4-", wantErr: "incomplete download", wantPart: photo[:10]},
+	}
+	defer SetHost("")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotRange string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/info") {
+					fmt.Fprintf(w, `{"errCode": 200, "size": %d}`, len(photo))
+					return
+				}
+				gotRange = r.Header.Get("Range")
+				body := photo
+				var start int
+				if tt.honourRange && gotRange != "" {
+					fmt.Sscanf(gotRange, "bytes=%d-", &start)
+					body = photo[start:]
+					w.WriteHeader(http.StatusPartialContent)
+				}
+				if tt.short {
+					body = body[:len(body)-6]
+				}
+				w.Write([]byte(body))
+			}))
+			defer server.Close()
+			SetHost(server.URL)
+
+			dst := filepath.Join(t.TempDir(), "R0000001.JPG")
+			if tt.part != "" {
+				if err := os.WriteFile(dst+PartSuffix, []byte(tt.part), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var total, minimum int64
+			err := DownloadWiFi(context.Background(), "100RICOH/R0000001.JPG", dst, Config{}, func(n int64) {
+				total += n
+				minimum = min(minimum, n)
+			})
+
+			if gotRange != tt.wantRange {
+				t.Errorf("Range header = %q, want %q", gotRange, tt.wantRange)
+			}
+			if minimum != tt.wantMinimum {
+				t.Errorf("most negative progress = %d, want %d", minimum, tt.wantMinimum)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("DownloadWiFi() error = %v, want %q", err, tt.wantErr)
+				}
+				if _, err := os.Stat(dst); err == nil {
+					t.Errorf("incomplete download was moved to %s", dst)
+				}
+				if data, _ := os.ReadFile(dst + PartSuffix); string(data) != tt.wantPart {
+					t.Errorf("partial file = %q, want %q", data, tt.wantPart)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DownloadWiFi() error = %v", err)
+			}
+			if data, _ := os.ReadFile(dst); string(data) != photo {
+				t.Errorf("downloaded %q, want %q", data, photo)
+			}
+			if _, err := os.Stat(dst + PartSuffix); err == nil {
+				t.Errorf("partial file was left behind")
+			}
+			if total != int64(len(photo)) {
+				t.Errorf("progress adds up to %d, want %d", total, len(photo))
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event types written to the event stream
+const (
+	EventConnection   = "connection"    // state is waiting, connected or disconnected
+	EventScan         = "scan"          // photos found on the camera
+	EventFileStart    = "file_start"    // a download started
+	EventProgress     = "progress"      // bytes of the current download so far
+	EventFileDone     = "file_done"     // a download finished and was verified
+	EventFileFailed   = "file_failed"   // a download failed for good
+	EventFileCanceled = "file_canceled" // a download was cancelled
+	EventFileSkipped  = "file_skipped"  // a photo wasn't downloaded, e.g. by the collision policy
+	EventBatch        = "batch"         // summary once a batch of downloads is done
+)
+
+// How often progress events are written per download
+const eventProgressInterval = 250 * time.Millisecond
+
+var (
+	events   *json.Encoder
+	eventsMu sync.Mutex
+)
+
+// SetEventWriter makes the events of this run go to w as newline-delimited
+// JSON. Events are dropped until it's called.
+func SetEventWriter(w io.Writer) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	events = json.NewEncoder(w)
+}
+
+// emit writes an event of the given type with its fields
+func emit(eventType string, fields map[string]interface{}) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	if events == nil {
+		return
+	}
+	fields["time"] = time.Now().Format(time.RFC3339Nano)
+	fields["type"] = eventType
+	events.Encode(fields)
+}
+
+// EmitConnection reports the camera connection state
+func EmitConnection(state string, method ConnectionMethod) {
+	emit(EventConnection, map[string]interface{}{"state": state, "method": method})
+}
+
+// EmitScan reports the photos found on the camera and how many of them are new
+func EmitScan(photos, newPhotos int) {
+	emit(EventScan, map[string]interface{}{"photos": photos, "new": newPhotos})
+}
+
+// EmitBatch reports the outcome of a batch of downloads
+func EmitBatch(files, imported, skipped, failed int, bytes int64, elapsed time.Duration) {
+	emit(EventBatch, map[string]interface{}{
+		"files":    files,
+		"imported": imported,
+		"skipped":  skipped,
+		"failed":   failed,
+		"bytes":    bytes,
+		"seconds":  elapsed.Seconds(),
+	})
+}
+
+// progressEmitter turns progress callbacks into throttled progress events
+type progressEmitter struct {
+	name  string
+	total int64
+	done  int64
+	last  time.Time
+}
+
+func (p *progressEmitter) add(n int64) {
+	p.done += n
+	// Without a known size there is no final chunk to wait for
+	if time.Since(p.last) < eventProgressInterval && (p.total <= 0 || p.done < p.total) {
+		return
+	}
+	p.last = time.Now()
+	emit(EventProgress, map[string]interface{}{"name": p.name, "bytes": p.done, "total": p.total})
+}
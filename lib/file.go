@@ -1,9 +1,12 @@
 package lib
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -13,7 +16,11 @@ var (
 	photos []string
 )
 
-func CopyFile(srcPath, dstPath string) error {
+// CopyFile copies srcPath to dstPath, stopping early if ctx is cancelled. The
+// copy is written to a temporary file next to dstPath, synced to disk and only
+// then renamed into place, so an interrupted copy never looks downloaded.
+// Progress is reported to onProgress as bytes are copied.
+func CopyFile(ctx context.Context, srcPath, dstPath string, onProgress ProgressFunc) error {
 	src, err := os.Open(srcPath)
 	if err != nil {
 		return err
@@ -25,22 +32,109 @@ func CopyFile(srcPath, dstPath string) error {
 		return fmt.Errorf("Failed to create destination directory during download: %v\n", err)
 	}
 
-	dst, err := os.Create(dstPath)
+	partPath := dstPath + PartSuffix
+	dst, err := os.Create(partPath)
 	if err != nil {
 		return err
 	}
-	defer dst.Close()
 
-	_, err = io.Copy(dst, src)
-	return err
+	_, err = io.Copy(dst, &contextReader{ctx: ctx, r: &progressReader{r: src, onProgress: onProgress}})
+	if err == nil {
+		err = dst.Sync()
+	}
+	// A failed close can mean the data never made it to disk
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partPath)
+		return err
+	}
+	return os.Rename(partPath, dstPath)
+}
+
+// DeleteFromCard removes a photo from the mounted camera, but only once its
+// local copy has been confirmed to match the card byte for byte.
+func DeleteFromCard(name, localPath string, cfg Config) error {
+	if cfg.ConnectionMethod != ConnectionMethodUSB {
+		return fmt.Errorf("deleting from the card is only supported over USB")
+	}
+	srcPath := filepath.Join(cfg.UsbSettings.CameraDir, name)
+
+	srcSum, err := fileChecksum(srcPath)
+	if err != nil {
+		return fmt.Errorf("couldn't checksum %s on the card: %v", name, err)
+	}
+	dstSum, err := fileChecksum(localPath)
+	if err != nil {
+		return fmt.Errorf("couldn't checksum local copy: %v", err)
+	}
+	if !bytes.Equal(srcSum, dstSum) {
+		return fmt.Errorf("local copy doesn't match the card, not deleting")
+	}
+
+	if err := os.Remove(srcPath); err != nil {
+		return err
+	}
+	forgetCapture(name)
+	return nil
+}
+
+// SetCaptureTime sets a downloaded file's access and modification times to
+// when the photo was taken, so sorting by date works in other tools. Over USB
+// the card file's modification time is used, over WiFi the camera's datetime.
+func SetCaptureTime(name, localPath string, cfg Config) error {
+	var captured time.Time
+	switch cfg.ConnectionMethod {
+	case ConnectionMethodUSB:
+		stat, err := os.Stat(filepath.Join(cfg.UsbSettings.CameraDir, name))
+		if err != nil {
+			return err
+		}
+		captured = stat.ModTime()
+	case ConnectionMethodWiFi:
+		captured = lookupCapture(name, cfg).Time
+	}
+	if captured.IsZero() {
+		return fmt.Errorf("camera didn't report a capture time for %s", name)
+	}
+	return os.Chtimes(localPath, captured, captured)
+}
+
+// SourceSize returns the size of a photo on the camera
+func SourceSize(name string, cfg Config) int64 {
+	return lookupCapture(name, cfg).Size
 }
 
-func ScanCameraUsb(out *[]string, cfg Config) {
+// PhotoDetails returns what the camera reports about a photo. Over USB only
+// the model, size and capture time are known.
+func PhotoDetails(name string, cfg Config) (PhotoInfo, error) {
+	info, err := loadCapture(name, cfg)
+	if err != nil {
+		return PhotoInfo{}, fmt.Errorf("couldn't read details of %s: %w", name, err)
+	}
+	details := info.Photo
+	details.Dir, details.File = path.Split(name)
+	details.Dir = strings.TrimSuffix(details.Dir, "/")
+	details.CameraModel = info.Model
+	details.Size = info.Size
+	if !info.Time.IsZero() {
+		details.Datetime = info.Time.Format("2006-01-02T15:04:05")
+	}
+	return details, nil
+}
+
+// ScanCameraUsb lists the photos in the camera directory. It fails if the
+// directory itself can't be read, e.g. because the camera isn't mounted.
+func ScanCameraUsb(out *[]string, cfg Config) error {
 	var photos []string
 
 	root := cfg.UsbSettings.CameraDir
-	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
+			if path == root {
+				return err
+			}
 			return nil
 		}
 
@@ -57,21 +151,28 @@ func ScanCameraUsb(out *[]string, cfg Config) {
 		}
 		return nil
 	})
+	if err != nil {
+		return fmt.Errorf("couldn't read camera directory: %w", err)
+	}
 
 	*out = photos
+	return nil
 }
 
 func GetFileInfo(name string, cfg Config, existingFiles map[string]bool) (size int64, modTime time.Time, exists bool) {
 	// Switch on connection method
 
 	// Check if the file exists in the download directory first
+	// If it was moved away since import, fall back to the camera
 	if existingFiles[name] {
-		path := filepath.Join(cfg.DownloadDir, name)
-		info, err := os.Stat(path)
-		if err != nil {
-			return 0, time.Time{}, false
+		if info, err := os.Stat(ImportedPath(name, cfg)); err == nil {
+			// Report when the photo was taken rather than when it was downloaded
+			captured := lookupCapture(name, cfg).Time
+			if captured.IsZero() {
+				captured = info.ModTime()
+			}
+			return info.Size(), captured, true
 		}
-		return info.Size(), info.ModTime(), true
 	}
 
 	switch cfg.ConnectionMethod {
@@ -84,7 +185,10 @@ func GetFileInfo(name string, cfg Config, existingFiles map[string]bool) (size i
 		return info.Size(), info.ModTime(), true
 
 	case ConnectionMethodWiFi:
-		photoInfo := wifiGetPhotoInfo(name, cfg.Mock)
+		photoInfo, err := wifiGetPhotoInfo(name, cfg.Mock)
+		if err != nil {
+			return 0, time.Time{}, false
+		}
 		// Example format: "2024-07-01T12:34:56"
 		t, err := time.Parse("2006-01-02T15:04:05", photoInfo.Datetime)
 		if err != nil {
@@ -96,7 +200,13 @@ func GetFileInfo(name string, cfg Config, existingFiles map[string]bool) (size i
 	}
 }
 
-func ScanDownloadDir(existingFiles map[string]bool, cfg Config) {
+// ScanDownloadDir marks which camera photos have already been downloaded.
+// Photos are looked up in the import manifest and at the path given by the
+// path template, so existingFiles is keyed by camera path even when the local
+// layout differs or files were moved after import. A local file at that path
+// only counts if it is the same shot; otherwise the photo is returned as a
+// collision so it isn't hidden.
+func ScanDownloadDir(existingFiles map[string]bool, photos []string, cfg Config) (collisions map[string]bool) {
 	root := cfg.DownloadDir
 
 	found := make(map[string]struct{})
@@ -105,7 +215,12 @@ func ScanDownloadDir(existingFiles map[string]bool, cfg Config) {
 		if err != nil {
 			return nil
 		}
-		if !d.IsDir() {
+		// Files that failed verification don't count as downloaded
+		if d.IsDir() && path == filepath.Join(root, QuarantineDirName) {
+			return filepath.SkipDir
+		}
+		// Partial downloads don't count as downloaded
+		if !d.IsDir() && !isPartFile(d.Name()) {
 			rel, relErr := filepath.Rel(root, path)
 			if relErr == nil {
 				rel = strings.ReplaceAll(rel, string(filepath.Separator), "/")
@@ -115,15 +230,32 @@ func ScanDownloadDir(existingFiles map[string]bool, cfg Config) {
 		return nil
 	})
 
-	// Remove files not found
-	for k := range existingFiles {
-		if _, ok := found[k]; !ok {
-			delete(existingFiles, k)
+	collisions = make(map[string]bool)
+	onCamera := make(map[string]struct{}, len(photos))
+	for _, name := range photos {
+		onCamera[name] = struct{}{}
+		if IsImported(name, cfg) {
+			existingFiles[name] = true
+			continue
+		}
+		localPath := LocalPath(name, cfg)
+		if _, ok := found[localPath]; !ok {
+			delete(existingFiles, name)
+			continue
+		}
+		if sameShot(name, filepath.Join(root, filepath.FromSlash(localPath)), cfg) {
+			existingFiles[name] = true
+		} else {
+			delete(existingFiles, name)
+			collisions[name] = true
 		}
 	}
 
-	// Add new found files
-	for k := range found {
-		existingFiles[k] = true
+	// Forget photos that are no longer on the camera
+	for k := range existingFiles {
+		if _, ok := onCamera[k]; !ok {
+			delete(existingFiles, k)
+		}
 	}
+	return collisions
 }
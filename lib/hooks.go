@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+type HookSettings struct {
+	AfterFile      string `json:"after_file"`      // run after each photo is downloaded
+	AfterBatch     string `json:"after_batch"`     // run once the queue has finished a batch
+	TimeoutSeconds int    `json:"timeout_seconds"` // hooks still running after this are killed
+}
+
+// hookWaitDelay is how long a hook's output is waited for once it exited or
+// was killed, in case a process it started in the background still holds it
+const hookWaitDelay = 5 * time.Second
+
+func defaultHookSettings() HookSettings {
+	return HookSettings{
+		TimeoutSeconds: 60,
+	}
+}
+
+// HookFile describes a downloaded photo to a hook
+type HookFile struct {
+	Source   string // camera path, e.g. 100RICOH/R0001234.JPG
+	Dest     string // local path it was saved to
+	Size     int64
+	Captured time.Time
+}
+
+// NewHookFile describes a camera photo that was saved to dstPath
+func NewHookFile(name, dstPath string, cfg Config) HookFile {
+	info := lookupCapture(name, cfg)
+	file := HookFile{Source: name, Dest: dstPath, Size: info.Size, Captured: info.Time}
+	if stat, err := os.Stat(dstPath); err == nil {
+		file.Size = stat.Size()
+	}
+	return file
+}
+
+// HookResult is what a hook printed and how it exited
+type HookResult struct {
+	Output   string
+	ExitCode int
+	Err      error
+}
+
+func (f HookFile) env() []string {
+	captured := ""
+	if !f.Captured.IsZero() {
+		captured = f.Captured.Format(time.RFC3339)
+	}
+	return []string{
+		"GRSYNC_SOURCE=" + f.Source,
+		"GRSYNC_DEST=" + f.Dest,
+		fmt.Sprintf("GRSYNC_SIZE=%d", f.Size),
+		"GRSYNC_CAPTURE_TIME=" + captured,
+	}
+}
+
+// RunAfterFileHook runs the after_file hook for a downloaded photo. It returns
+// nil if no hook is configured. It waits for the hook, so the download queue
+// doesn't move on until it has finished.
+func RunAfterFileHook(file HookFile, cfg Config) *HookResult {
+	if cfg.Hooks.AfterFile == "" {
+		return nil
+	}
+	return runHook(cfg.Hooks.AfterFile, append(file.env(), "GRSYNC_DOWNLOAD_DIR="+cfg.DownloadDir), cfg.Hooks)
+}
+
+// RunAfterBatchHook runs the after_batch hook with the photos downloaded in
+// the batch. File lists are passed one path per line. It returns nil if no
+// hook is configured.
+func RunAfterBatchHook(files []HookFile, cfg Config) *HookResult {
+	if cfg.Hooks.AfterBatch == "" {
+		return nil
+	}
+	var sources, dests []string
+	for _, f := range files {
+		sources = append(sources, f.Source)
+		dests = append(dests, f.Dest)
+	}
+	env := []string{
+		"GRSYNC_DOWNLOAD_DIR=" + cfg.DownloadDir,
+		fmt.Sprintf("GRSYNC_COUNT=%d", len(files)),
+		"GRSYNC_SOURCES=" + strings.Join(sources, "\n"),
+		"GRSYNC_FILES=" + strings.Join(dests, "\n"),
+	}
+	return runHook(cfg.Hooks.AfterBatch, env, cfg.Hooks)
+}
+
+func runHook(command string, env []string, settings HookSettings) *HookResult {
+	timeout := time.Duration(settings.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = time.Duration(defaultHookSettings().TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), env...)
+	cmd.WaitDelay = hookWaitDelay
+
+	output, err := cmd.CombinedOutput()
+	result := &HookResult{Output: strings.TrimSpace(string(output)), ExitCode: cmd.ProcessState.ExitCode()}
+	if ctx.Err() == context.DeadlineExceeded {
+		result.Err = fmt.Errorf("timed out after %s", timeout)
+	} else if errors.Is(err, exec.ErrWaitDelay) {
+		result.Err = errors.New("a background process it started kept its output open, redirect that process's output")
+	} else if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			result.Err = err
+		}
+	}
+	return result
+}
@@ -1,13 +1,109 @@
 package lib
 
 import (
+	"bytes"
 	"fmt"
+	"github.com/nfnt/resize"
 	"github.com/rwcarlsen/goexif/exif"
 	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+// Longest side of preview images, they are only shown in a terminal
+const previewMax = 320
+
+// LoadPreview reads a photo, from the download directory if it was imported
+// and is still there, otherwise from the camera, and returns a small upright
+// version of it
+func LoadPreview(name string, imported bool, cfg Config) (image.Image, error) {
+	var file io.ReadCloser
+	if imported {
+		if f, err := os.Open(ImportedPath(name, cfg)); err == nil {
+			file = f
+		}
+	}
+	// Photos that were moved or deleted after import are read from the camera
+	if file == nil {
+		switch cfg.ConnectionMethod {
+		case ConnectionMethodUSB:
+			f, err := os.Open(filepath.Join(cfg.UsbSettings.CameraDir, name))
+			if err != nil {
+				return nil, fmt.Errorf("failed to open local file: %w", err)
+			}
+			file = f
+		case ConnectionMethodWiFi:
+			resp, err := http.Get(GRPhotoListURL() + "/" + name + "?size=view")
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch image from camera: %w", err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				resp.Body.Close()
+				return nil, fmt.Errorf("failed to fetch image from camera: %w", &StatusError{Code: resp.StatusCode, Status: resp.Status})
+			}
+			file = resp.Body
+		default:
+			return nil, fmt.Errorf("unknown connection method %q, check config", cfg.ConnectionMethod)
+		}
+	}
+	defer file.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(file); err != nil {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	// Shrink the image first to speed up rotating and drawing it
+	img = resize.Thumbnail(previewMax, previewMax, img, resize.Lanczos3)
+
+	if x, err := exif.Decode(bytes.NewReader(buf.Bytes())); err == nil {
+		if orientTag, err := x.Get(exif.Orientation); err == nil {
+			orient, _ := orientTag.Int(0)
+			img = ApplyOrientation(img, orient)
+		}
+	}
+	return img, nil
+}
+
+// Characters from dark to light for ASCIIArt
+const asciiRamp = " .:-=+*#%@"
+
+// ASCIIArt draws an image as lines of plain text, width characters wide
+func ASCIIArt(img image.Image, width int) []string {
+	bounds := img.Bounds()
+	if width <= 0 || bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return nil
+	}
+	// Terminal cells are roughly twice as tall as they are wide
+	height := width * bounds.Dy() / bounds.Dx() / 2
+	if height < 1 {
+		height = 1
+	}
+	small := resize.Resize(uint(width), uint(height), img, resize.Bilinear)
+
+	lines := make([]string, 0, height)
+	for y := 0; y < height; y++ {
+		var line strings.Builder
+		for x := 0; x < width; x++ {
+			r, g, b, _ := small.At(small.Bounds().Min.X+x, small.Bounds().Min.Y+y).RGBA()
+			// Perceived brightness, 0-65535
+			lum := (299*r + 587*g + 114*b) / 1000
+			line.WriteByte(asciiRamp[int(lum)*(len(asciiRamp)-1)/65535])
+		}
+		lines = append(lines, line.String())
+	}
+	return lines
+}
+
 func ApplyOrientation(img image.Image, orientation int) image.Image {
 	switch orientation {
 	case 3:
@@ -67,7 +163,7 @@ func getFNumber(x *exif.Exif) string {
 }
 
 func ExtractExifInfo(name string, cfg Config) interface{} {
-	path := filepath.Join(cfg.DownloadDir, name)
+	path := ImportedPath(name, cfg)
 	exifInfo := ""
 	file, err := os.Open(path)
 	if err == nil {
@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LogLevel tells log output apart so frontends can style it
+type LogLevel int
+
+const (
+	LogInfo   LogLevel = iota // progress, e.g. a download starting
+	LogOutput                 // output of a hook
+	LogError                  // something went wrong
+	LogDone                   // a photo finished
+)
+
+// LogFunc receives messages while photos are imported
+type LogFunc func(level LogLevel, message string)
+
+// ScanCamera lists the photos on the camera
+func ScanCamera(cfg Config) ([]string, error) {
+	var photos []string
+	var err error
+	switch cfg.ConnectionMethod {
+	case ConnectionMethodUSB:
+		err = ScanCameraUsb(&photos, cfg)
+	case ConnectionMethodWiFi:
+		err = ScanCameraWiFi(&photos, cfg.Mock)
+	default:
+		return nil, fmt.Errorf("unknown connection method %q, check config", cfg.ConnectionMethod)
+	}
+	return photos, err
+}
+
+// ImportPhoto downloads a photo from the camera and verifies it, then sets its
+// file time, records the import, writes its sidecar and runs the after_file
+// hook. It returns where the photo was saved.
+func ImportPhoto(ctx context.Context, name string, cfg Config, onProgress ProgressFunc, logf LogFunc) (string, error) {
+	srcPath := filepath.Join(cfg.UsbSettings.CameraDir, name)
+	fileSize := SourceSize(name, cfg)
+
+	dstPath, err := ResolveDestPath(name, cfg)
+	if errors.Is(err, ErrCollisionSkipped) {
+		logf(LogError, fmt.Sprintf("Skipped %s: %v", name, err))
+		emit(EventFileSkipped, map[string]interface{}{"name": name, "reason": err.Error()})
+		return "", err
+	}
+	if err != nil {
+		logf(LogError, fmt.Sprintf("Couldn't pick a local path for %s: %v", name, err))
+		emitFileFailed(name, err)
+		return "", err
+	}
+	emit(EventFileStart, map[string]interface{}{"name": name, "size": fileSize})
+	if dstPath != DestPath(name, cfg) {
+		logf(LogInfo, fmt.Sprintf("%s clashes with a different local photo, saving to %s", name, dstPath))
+	}
+
+	var fileDone int64
+	progress := &progressEmitter{name: name, total: fileSize}
+	countProgress := func(n int64) {
+		fileDone += n
+		onProgress(n)
+		progress.add(n)
+	}
+
+	transfer := func() error {
+		switch cfg.ConnectionMethod {
+		case ConnectionMethodUSB:
+			return CopyFile(ctx, srcPath, dstPath, countProgress)
+		case ConnectionMethodWiFi:
+			return DownloadWiFi(ctx, name, dstPath, cfg, countProgress)
+		default:
+			return fmt.Errorf("unknown connection method %q, check config", cfg.ConnectionMethod)
+		}
+	}
+	onRetry := func(attempt int, delay time.Duration, err error) {
+		logf(LogInfo, fmt.Sprintf("Download of %s failed (%v), retry %d/%d in %s", name, err, attempt, cfg.Retry.Attempts, delay))
+		// WiFi retries resume and report the bytes they already have again
+		onProgress(-fileDone)
+		progress.add(-fileDone)
+		fileDone = 0
+	}
+
+	perFileStart := time.Now()
+	if cfg.ConnectionMethod == ConnectionMethodUSB {
+		logf(LogInfo, fmt.Sprintf("Local download %s", srcPath))
+	} else {
+		logf(LogInfo, fmt.Sprintf("WiFi download %s", name))
+	}
+	if err := WithRetry(ctx, cfg.Retry, transfer, onRetry); err != nil {
+		if ctx.Err() == nil {
+			logf(LogError, fmt.Sprintf("Failed to download %s: %v", name, err))
+			emitFileFailed(name, err)
+		} else {
+			emit(EventFileCanceled, map[string]interface{}{"name": name})
+		}
+		return "", err
+	}
+
+	if err := VerifyDownload(name, dstPath, fileSize, cfg); err != nil {
+		logf(LogError, fmt.Sprintf("Verification failed for %s: %v", name, err))
+		if qPath, qErr := QuarantineFile(dstPath, name, cfg); qErr != nil {
+			logf(LogError, fmt.Sprintf("Couldn't quarantine %s: %v", name, qErr))
+		} else {
+			logf(LogError, fmt.Sprintf("Moved %s to %s", name, qPath))
+		}
+		err = fmt.Errorf("verification failed, moved to %s: %v", QuarantineDirName, err)
+		emitFileFailed(name, err)
+		return "", err
+	}
+
+	if err := SetCaptureTime(name, dstPath, cfg); err != nil {
+		logf(LogInfo, fmt.Sprintf("Couldn't set file time of %s: %v", name, err))
+	}
+
+	if err := RecordImport(name, dstPath, cfg); err != nil {
+		logf(LogError, fmt.Sprintf("Couldn't record import of %s: %v", name, err))
+	}
+
+	if cfg.XmpSidecar {
+		if err := WriteXmpSidecar(name, dstPath, cfg); err != nil {
+			logf(LogError, fmt.Sprintf("Couldn't write XMP sidecar for %s: %v", name, err))
+		}
+	}
+
+	elapsed := time.Since(perFileStart).Seconds()
+	logf(LogDone, fmt.Sprintf("Downloaded %s in %.2f seconds", name, elapsed))
+	emit(EventFileDone, map[string]interface{}{"name": name, "path": dstPath, "bytes": fileDone, "seconds": elapsed})
+
+	LogHook("after_file", RunAfterFileHook(NewHookFile(name, dstPath, cfg), cfg), logf)
+	return dstPath, nil
+}
+
+func emitFileFailed(name string, err error) {
+	emit(EventFileFailed, map[string]interface{}{"name": name, "error": err.Error()})
+}
+
+// LogHook passes a hook's output and exit status on to logf
+func LogHook(name string, result *HookResult, logf LogFunc) {
+	if result == nil {
+		return
+	}
+	for _, line := range strings.Split(result.Output, "\n") {
+		if line != "" {
+			logf(LogOutput, fmt.Sprintf("%s: %s", name, line))
+		}
+	}
+	switch {
+	case result.Err != nil:
+		logf(LogError, fmt.Sprintf("%s hook failed: %v", name, result.Err))
+	case result.ExitCode != 0:
+		logf(LogError, fmt.Sprintf("%s hook exited with status %d", name, result.ExitCode))
+	}
+}
@@ -2,18 +2,38 @@ package lib
 
 import (
 	"bytes"
+	"sync"
+
 	"github.com/rivo/tview"
 )
 
+// The log is written from the download queue and other goroutines, and shown
+// by the UI goroutine with SetLogText
 var (
-	log = bytes.Buffer{}
+	log       = bytes.Buffer{}
+	logMu     sync.Mutex
+	logUnseen bool // lines written since the log box was last updated
 )
 
-func WriteLog(message string, logBox *tview.TextView) {
+// WriteLog adds a line to the log. It's safe to call from any goroutine, the
+// log box shows it on its next update.
+func WriteLog(message string) {
+	logMu.Lock()
+	defer logMu.Unlock()
 	log.WriteString(message + "\n")
-	logBox.ScrollToEnd()
+	logUnseen = true
 }
 
+// SetLogText shows the log in logBox, scrolled to the end if lines were added.
+// It must be called on the UI goroutine.
 func SetLogText(logBox *tview.TextView) {
-	logBox.SetText(log.String())
+	logMu.Lock()
+	text, unseen := log.String(), logUnseen
+	logUnseen = false
+	logMu.Unlock()
+
+	logBox.SetText(text)
+	if unseen {
+		logBox.ScrollToEnd()
+	}
 }
@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const manifestFileName = "grsync-tui-imports.jsonl"
+
+// ImportRecord is one line of the import manifest
+type ImportRecord struct {
+	Camera      string    `json:"camera"`
+	CameraPath  string    `json:"camera_path"`
+	Size        int64     `json:"size"`
+	CaptureTime string    `json:"capture_time"`
+	LocalPath   string    `json:"local_path"`
+	ImportedAt  time.Time `json:"imported_at"`
+}
+
+func (r ImportRecord) key() string {
+	return fmt.Sprintf("%s|%s|%d|%s", r.Camera, r.CameraPath, r.Size, r.CaptureTime)
+}
+
+var (
+	manifest      = make(map[string]ImportRecord)
+	manifestPaths = make(map[string]bool) // camera paths with at least one record
+	manifestMu    sync.Mutex
+)
+
+func manifestFilePath() string {
+	return filepath.Join(filepath.Dir(configFilePath()), manifestFileName)
+}
+
+// LoadManifest reads the import manifest so previously imported photos are
+// recognised even after they have been moved or renamed locally.
+func LoadManifest() error {
+	f, err := os.Open(manifestFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec ImportRecord
+		// Skip lines we can't read rather than losing the whole manifest
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		manifest[rec.key()] = rec
+		manifestPaths[rec.CameraPath] = true
+	}
+	return scanner.Err()
+}
+
+// newImportRecord describes a camera photo without the local details filled in
+func newImportRecord(name string, cfg Config) ImportRecord {
+	info := lookupCapture(name, cfg)
+	return ImportRecord{
+		Camera:      info.Model,
+		CameraPath:  name,
+		Size:        info.Size,
+		CaptureTime: info.Time.Format("2006-01-02T15:04:05"),
+	}
+}
+
+// lookupImport returns the manifest entry for a camera photo, if any
+func lookupImport(name string, cfg Config) (ImportRecord, bool) {
+	manifestMu.Lock()
+	known := manifestPaths[name]
+	manifestMu.Unlock()
+	// Avoid asking the camera about photos that were never imported
+	if !known {
+		return ImportRecord{}, false
+	}
+
+	key := newImportRecord(name, cfg).key()
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	rec, ok := manifest[key]
+	return rec, ok
+}
+
+// IsImported reports whether a camera photo is in the import manifest
+func IsImported(name string, cfg Config) bool {
+	_, ok := lookupImport(name, cfg)
+	return ok
+}
+
+// ImportedPath returns where a downloaded photo can be found locally. The
+// manifest's recorded location wins while it still exists, otherwise the
+// path from the path template is used.
+func ImportedPath(name string, cfg Config) string {
+	if rec, ok := lookupImport(name, cfg); ok {
+		if _, err := os.Stat(rec.LocalPath); err == nil {
+			return rec.LocalPath
+		}
+	}
+	return DestPath(name, cfg)
+}
+
+// RecordImport appends a photo to the import manifest
+func RecordImport(name, localPath string, cfg Config) error {
+	rec := newImportRecord(name, cfg)
+	rec.LocalPath = localPath
+	rec.ImportedAt = time.Now()
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+
+	path := manifestFilePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	manifest[rec.key()] = rec
+	manifestPaths[rec.CameraPath] = true
+	return nil
+}
@@ -0,0 +1,126 @@
+package lib
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// FormatFilter limits which files of a RAW+JPEG pair are acted on
+type FormatFilter string
+
+const (
+	FormatBoth FormatFilter = "both"
+	FormatJPEG FormatFilter = "jpeg"
+	FormatDNG  FormatFilter = "dng"
+)
+
+// Next cycles through the filters
+func (f FormatFilter) Next() FormatFilter {
+	switch f {
+	case FormatJPEG:
+		return FormatDNG
+	case FormatDNG:
+		return FormatBoth
+	default:
+		return FormatJPEG
+	}
+}
+
+func (f FormatFilter) String() string {
+	switch f {
+	case FormatJPEG:
+		return "JPEG only"
+	case FormatDNG:
+		return "DNG only"
+	default:
+		return "JPEG + DNG"
+	}
+}
+
+// Matches reports whether a file passes the filter
+func (f FormatFilter) Matches(name string) bool {
+	switch f {
+	case FormatJPEG:
+		return isJPEG(name)
+	case FormatDNG:
+		return isDNG(name)
+	default:
+		return true
+	}
+}
+
+func isJPEG(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".jpg" || ext == ".jpeg"
+}
+
+func isDNG(name string) bool {
+	return strings.ToLower(path.Ext(name)) == ".dng"
+}
+
+// PhotoGroup is one shot on the camera, which may have been saved as both a
+// JPEG and a DNG
+type PhotoGroup struct {
+	Base  string   // camera path without the extension, e.g. 100RICOH/R0001234
+	Files []string // camera paths, the JPEG first
+}
+
+// GroupPhotos pairs up files that share a folder and file name, keeping the
+// camera's order
+func GroupPhotos(photos []string) []PhotoGroup {
+	var groups []PhotoGroup
+	index := make(map[string]int)
+	for _, name := range photos {
+		base := strings.TrimSuffix(name, path.Ext(name))
+		key := strings.ToUpper(base)
+		if i, ok := index[key]; ok {
+			if isJPEG(name) {
+				groups[i].Files = append([]string{name}, groups[i].Files...)
+			} else {
+				groups[i].Files = append(groups[i].Files, name)
+			}
+			continue
+		}
+		index[key] = len(groups)
+		groups = append(groups, PhotoGroup{Base: base, Files: []string{name}})
+	}
+	return groups
+}
+
+// Primary is the file used for previews and metadata, the JPEG if there is one
+func (g PhotoGroup) Primary() string {
+	return g.Files[0]
+}
+
+// Formats lists the file extensions in the group, e.g. "JPG+DNG"
+func (g PhotoGroup) Formats() string {
+	var exts []string
+	for _, name := range g.Files {
+		exts = append(exts, strings.ToUpper(strings.TrimPrefix(path.Ext(name), ".")))
+	}
+	return strings.Join(exts, "+")
+}
+
+// Filtered returns the files in the group that pass the filter
+func (g PhotoGroup) Filtered(filter FormatFilter) []string {
+	var files []string
+	for _, name := range g.Files {
+		if filter.Matches(name) {
+			files = append(files, name)
+		}
+	}
+	return files
+}
+
+// ParseFormatFilter checks a format_filter config value
+func ParseFormatFilter(value string) (FormatFilter, error) {
+	switch f := FormatFilter(strings.ToLower(value)); f {
+	case "", FormatBoth:
+		return FormatBoth, nil
+	case FormatJPEG, FormatDNG:
+		return f, nil
+	default:
+		return FormatBoth, fmt.Errorf("unknown format filter %q, use both, jpeg or dng", value)
+	}
+}
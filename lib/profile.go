@@ -0,0 +1,55 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Profile holds the settings that differ between cameras. Settings left empty
+// fall back to the ones at the top of the config.
+type Profile struct {
+	ConnectionMethod ConnectionMethod `json:"connection_method,omitempty"`
+	Host             string           `json:"host,omitempty"`
+	CameraDir        string           `json:"camera_dir,omitempty"`
+	DownloadDir      string           `json:"download_dir,omitempty"`
+}
+
+// ProfileNames lists the profiles of the config in alphabetical order
+func (cfg Config) ProfileNames() []string {
+	names := make([]string, 0, len(cfg.Profiles))
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithProfile returns cfg with the settings of the named profile layered over
+// it. An empty name returns cfg unchanged.
+func (cfg Config) WithProfile(name string) (Config, error) {
+	if name == "" {
+		return cfg, nil
+	}
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		if len(cfg.Profiles) == 0 {
+			return cfg, fmt.Errorf("unknown profile %q, the config has no profiles", name)
+		}
+		return cfg, fmt.Errorf("unknown profile %q, use one of %s", name, strings.Join(cfg.ProfileNames(), ", "))
+	}
+	if p.ConnectionMethod != "" {
+		cfg.ConnectionMethod = p.ConnectionMethod
+	}
+	if p.Host != "" {
+		cfg.WifiSettings.Host = p.Host
+	}
+	if p.CameraDir != "" {
+		cfg.UsbSettings.CameraDir = p.CameraDir
+	}
+	if p.DownloadDir != "" {
+		cfg.DownloadDir = p.DownloadDir
+	}
+	cfg.ActiveProfile = name
+	return cfg, nil
+}
@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWithProfile(t *testing.T) {
+	base := Config{
+		ConnectionMethod: ConnectionMethodWiFi,
+		DownloadDir:      "/photos",
+		FormatFilter:     FormatJPEG,
+		UsbSettings:      UsbSettings{CameraDir: "/mnt/camera", VerifyChecksum: true},
+		WifiSettings:     WifiSettings{Host: DefaultGRHost},
+		Profiles: map[string]Profile{
+			"gr3":   {ConnectionMethod: ConnectionMethodWiFi, Host: "http://10.0.0.1/", DownloadDir: "/photos/gr3"},
+			"gr3x":  {ConnectionMethod: ConnectionMethodUSB, CameraDir: "/media/GR3X", DownloadDir: "/photos/gr3x"},
+			"empty": {},
+		},
+	}
+
+	tests := []struct {
+		profile string
+		want    func(*Config)
+		wantErr string
+	}{
+		{"", func(c *Config) {}, ""},
+		{"gr3", func(c *Config) {
+			c.WifiSettings.Host = "http://10.0.0.1/"
+			c.DownloadDir = "/photos/gr3"
+			c.ActiveProfile = "gr3"
+		}, ""},
+		{"gr3x", func(c *Config) {
+			c.ConnectionMethod = ConnectionMethodUSB
+			c.UsbSettings.CameraDir = "/media/GR3X"
+			c.DownloadDir = "/photos/gr3x"
+			c.ActiveProfile = "gr3x"
+		}, ""},
+		// A profile without settings inherits all of them
+		{"empty", func(c *Config) { c.ActiveProfile = "empty" }, ""},
+		{"GR3", nil, "unknown profile"},
+		{"gr2", nil, "use one of empty, gr3, gr3x"},
+	}
+	for _, tt := range tests {
+		got, err := base.WithProfile(tt.profile)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("WithProfile(%q) error = %v, want %q", tt.profile, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("WithProfile(%q) error = %v", tt.profile, err)
+			continue
+		}
+		want := base
+		tt.want(&want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("WithProfile(%q) = %+v, want %+v", tt.profile, got, want)
+		}
+	}
+
+	if _, err := (Config{}).WithProfile("gr3"); err == nil || !strings.Contains(err.Error(), "no profiles") {
+		t.Errorf("WithProfile on a config without profiles: error = %v", err)
+	}
+	if base.UsbSettings.CameraDir != "/mnt/camera" || base.ActiveProfile != "" {
+		t.Errorf("WithProfile changed the config it was called on")
+	}
+}
+
+func TestProfileNames(t *testing.T) {
+	cfg := Config{Profiles: map[string]Profile{"b": {}, "a": {}, "c": {}}}
+	if got := cfg.ProfileNames(); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("ProfileNames() = %q", got)
+	}
+	if got := (Config{}).ProfileNames(); len(got) != 0 {
+		t.Errorf("ProfileNames() without profiles = %q", got)
+	}
+}
+
+func TestValidateProfiles(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name           string
+		profiles       map[string]Profile
+		defaultProfile string
+		want           []string
+	}{
+		{"no profiles", nil, "", nil},
+		{"valid", map[string]Profile{"gr3": {ConnectionMethod: ConnectionMethodWiFi}, "gr3x": {}}, "gr3x", nil},
+		{"unknown default", map[string]Profile{"gr3": {}}, "gr3x", []string{"default_profile:"}},
+		{"default without profiles", nil, "gr3", []string{"default_profile:"}},
+		{"bad method", map[string]Profile{"gr3": {ConnectionMethod: "bt"}}, "", []string{"profiles.gr3.connection_method:"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{
+				ConnectionMethod: ConnectionMethodWiFi,
+				DownloadDir:      filepath.Join(dir, "download"),
+				Profiles:         tt.profiles,
+				DefaultProfile:   tt.defaultProfile,
+			}
+			var problems []string
+			var cfgErr *ConfigError
+			if errors.As(ValidateConfig(cfg), &cfgErr) {
+				problems = cfgErr.Problems
+			}
+			if len(problems) != len(tt.want) {
+				t.Fatalf("got problems %q, want %d starting with %q", problems, len(tt.want), tt.want)
+			}
+			for i, want := range tt.want {
+				if !strings.HasPrefix(problems[i], want) {
+					t.Errorf("problem %d = %q, want it to start with %q", i, problems[i], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,411 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+type QueueState string
+
+const (
+	QueuePending   QueueState = "pending"
+	QueueActive    QueueState = "active"
+	QueueDone      QueueState = "done"
+	QueueFailed    QueueState = "failed"
+	QueueCancelled QueueState = "cancelled"
+	QueueSkipped   QueueState = "skipped" // left alone by the collision policy
+)
+
+// How often progress updates are passed on to OnChange
+const queueProgressInterval = 200 * time.Millisecond
+
+// QueueItem is a single photo in the transfer queue
+type QueueItem struct {
+	Name  string
+	State QueueState
+	Size  int64
+	Done  int64
+	Err   error
+}
+
+// QueueProgress summarises the current batch, i.e. everything queued since
+// the queue was last idle
+type QueueProgress struct {
+	Files     int
+	FilesDone int
+	Bytes     int64
+	BytesDone int64
+	Started   time.Time
+}
+
+// TransferFunc downloads one photo, reporting progress as it goes
+type TransferFunc func(ctx context.Context, name string, onProgress ProgressFunc) error
+
+// Queue transfers photos one at a time in the background while the UI keeps
+// running. Items can be added, reordered, cancelled and the queue paused at
+// any time.
+type Queue struct {
+	mu           sync.Mutex
+	items        []*QueueItem
+	batch        []*QueueItem
+	lastBatch    []*QueueItem // the batch that finished last, for RetryFailed
+	batchStart   time.Time
+	paused       bool
+	cancelActive context.CancelFunc
+	wake         chan struct{}
+	lastNotify   time.Time
+
+	transfer TransferFunc
+	sizeOf   func(name string) int64
+
+	// OnChange is called whenever the queue changes state
+	OnChange func()
+	// OnIdle is called when the last item of a batch has finished
+	OnIdle func(batch []QueueItem, elapsed time.Duration)
+}
+
+func NewQueue(transfer TransferFunc, sizeOf func(name string) int64) *Queue {
+	return &Queue{
+		transfer: transfer,
+		sizeOf:   sizeOf,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+func (q *Queue) notify() {
+	if q.OnChange != nil {
+		q.OnChange()
+	}
+}
+
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Add queues photos for download, skipping any that are already waiting or
+// being transferred. It returns how many were added.
+func (q *Queue) Add(names ...string) int {
+	q.mu.Lock()
+	added := 0
+	for _, name := range names {
+		if state, ok := q.stateLocked(name); ok && (state == QueuePending || state == QueueActive) {
+			continue
+		}
+		q.enqueueLocked(&QueueItem{Name: name, State: QueuePending})
+		added++
+	}
+	q.mu.Unlock()
+
+	if added > 0 {
+		q.signal()
+		q.notify()
+	}
+	return added
+}
+
+func (q *Queue) enqueueLocked(item *QueueItem) {
+	if len(q.batch) == 0 {
+		q.batchStart = time.Now()
+	}
+	// Drop older entries for the same photo so each shows up once
+	for i := 0; i < len(q.items); i++ {
+		if q.items[i].Name == item.Name && q.items[i] != item {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			i--
+		}
+	}
+	if !containsItem(q.items, item) {
+		q.items = append(q.items, item)
+	}
+	if !containsItem(q.batch, item) {
+		q.batch = append(q.batch, item)
+	}
+}
+
+func containsItem(items []*QueueItem, item *QueueItem) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Queue) stateLocked(name string) (QueueState, bool) {
+	for _, item := range q.items {
+		if item.Name == name {
+			return item.State, true
+		}
+	}
+	return "", false
+}
+
+// State returns the queue state of a photo, if it is in the queue
+func (q *Queue) State(name string) (QueueState, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stateLocked(name)
+}
+
+// Items returns a snapshot of the queue in processing order
+func (q *Queue) Items() []QueueItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := make([]QueueItem, len(q.items))
+	for i, item := range q.items {
+		items[i] = *item
+	}
+	return items
+}
+
+// Progress returns totals for the current batch
+func (q *Queue) Progress() QueueProgress {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p := QueueProgress{Started: q.batchStart}
+	for _, item := range q.batch {
+		// Cancelled, failed and skipped items no longer count towards the batch
+		if item.State == QueueCancelled || item.State == QueueFailed || item.State == QueueSkipped {
+			continue
+		}
+		p.Files++
+		p.Bytes += item.Size
+		p.BytesDone += item.Done
+		if item.State == QueueDone {
+			p.FilesDone++
+		}
+	}
+	return p
+}
+
+func (q *Queue) Paused() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.paused
+}
+
+// SetPaused pauses or resumes the queue. Pausing lets the active transfer
+// finish and holds everything after it.
+func (q *Queue) SetPaused(paused bool) {
+	q.mu.Lock()
+	q.paused = paused
+	q.mu.Unlock()
+	q.signal()
+	q.notify()
+}
+
+// Move shifts the item at index by delta places and returns its new index
+func (q *Queue) Move(index, delta int) int {
+	q.mu.Lock()
+	target := index + delta
+	if index < 0 || index >= len(q.items) || target < 0 || target >= len(q.items) {
+		q.mu.Unlock()
+		return index
+	}
+	q.items[index], q.items[target] = q.items[target], q.items[index]
+	q.mu.Unlock()
+	q.notify()
+	return target
+}
+
+// Cancel removes a pending item or aborts the active transfer at index
+func (q *Queue) Cancel(index int) {
+	q.mu.Lock()
+	if index < 0 || index >= len(q.items) {
+		q.mu.Unlock()
+		return
+	}
+	item := q.items[index]
+	switch item.State {
+	case QueuePending:
+		item.State = QueueCancelled
+	case QueueActive:
+		q.cancelActive()
+	}
+	q.mu.Unlock()
+	q.notify()
+}
+
+// CancelAll aborts the active transfer and drops everything still pending.
+// It returns the names of the photos that won't be downloaded.
+func (q *Queue) CancelAll() []string {
+	q.mu.Lock()
+	var names []string
+	for _, item := range q.items {
+		switch item.State {
+		case QueuePending:
+			item.State = QueueCancelled
+			names = append(names, item.Name)
+		case QueueActive:
+			q.cancelActive()
+			names = append(names, item.Name)
+		}
+	}
+	q.mu.Unlock()
+	q.notify()
+	return names
+}
+
+// RetryFailed puts the items that failed in the last finished batch back in
+// the queue and returns how many were re-queued. Failures from earlier
+// batches are left alone.
+func (q *Queue) RetryFailed() int {
+	q.mu.Lock()
+	retried := 0
+	for _, item := range q.lastBatch {
+		// Items queued again since, or cleared from the queue, are skipped
+		if item.State == QueueFailed && containsItem(q.items, item) {
+			item.State = QueuePending
+			item.Done = 0
+			item.Err = nil
+			q.enqueueLocked(item)
+			retried++
+		}
+	}
+	q.mu.Unlock()
+
+	if retried > 0 {
+		q.signal()
+		q.notify()
+	}
+	return retried
+}
+
+// ClearFinished removes done, cancelled and skipped items from the queue
+func (q *Queue) ClearFinished() {
+	q.mu.Lock()
+	var items []*QueueItem
+	for _, item := range q.items {
+		if item.State != QueueDone && item.State != QueueCancelled && item.State != QueueSkipped {
+			items = append(items, item)
+		}
+	}
+	q.items = items
+	q.mu.Unlock()
+	q.notify()
+}
+
+// next returns the first pending item, or nil if there is nothing to do
+func (q *Queue) next() *QueueItem {
+	if q.paused {
+		return nil
+	}
+	for _, item := range q.items {
+		if item.State == QueuePending {
+			return item
+		}
+	}
+	return nil
+}
+
+// sizeBatch looks up the size of every pending item so batch totals are
+// known up front
+func (q *Queue) sizeBatch() {
+	q.mu.Lock()
+	var unsized []*QueueItem
+	for _, item := range q.items {
+		if item.State == QueuePending && item.Size == 0 {
+			unsized = append(unsized, item)
+		}
+	}
+	q.mu.Unlock()
+
+	for _, item := range unsized {
+		size := q.sizeOf(item.Name)
+		q.mu.Lock()
+		item.Size = size
+		q.mu.Unlock()
+	}
+}
+
+// Run processes the queue until ctx is cancelled
+func (q *Queue) Run(ctx context.Context) {
+	for {
+		q.sizeBatch()
+
+		q.mu.Lock()
+		item := q.next()
+		if item == nil {
+			elapsed := time.Since(q.batchStart)
+			idle := q.batchFinishedLocked()
+			q.mu.Unlock()
+			if idle != nil && q.OnIdle != nil {
+				q.OnIdle(idle, elapsed)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.wake:
+			}
+			continue
+		}
+		itemCtx, cancel := context.WithCancel(ctx)
+		item.State = QueueActive
+		item.Done = 0
+		q.cancelActive = cancel
+		q.mu.Unlock()
+		q.notify()
+
+		err := q.transfer(itemCtx, item.Name, func(n int64) {
+			q.mu.Lock()
+			item.Done += n
+			throttled := time.Since(q.lastNotify) < queueProgressInterval
+			if !throttled {
+				q.lastNotify = time.Now()
+			}
+			q.mu.Unlock()
+			if !throttled {
+				q.notify()
+			}
+		})
+
+		q.mu.Lock()
+		switch {
+		case err == nil:
+			item.State = QueueDone
+			item.Done = item.Size
+		case errors.Is(err, context.Canceled):
+			item.State = QueueCancelled
+		case errors.Is(err, ErrCollisionSkipped):
+			item.State = QueueSkipped
+			item.Err = err
+		default:
+			item.State = QueueFailed
+			item.Err = err
+		}
+		q.cancelActive = nil
+		cancel()
+		q.mu.Unlock()
+		q.notify()
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// batchFinishedLocked returns the finished batch once nothing in it is left
+// to do, and starts a new one
+func (q *Queue) batchFinishedLocked() []QueueItem {
+	if len(q.batch) == 0 {
+		return nil
+	}
+	for _, item := range q.batch {
+		// A paused queue isn't idle while work is waiting
+		if item.State == QueuePending || item.State == QueueActive {
+			return nil
+		}
+	}
+	batch := make([]QueueItem, len(q.batch))
+	for i, item := range q.batch {
+		batch[i] = *item
+	}
+	q.lastBatch = q.batch
+	q.batch = nil
+	return batch
+}
@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+type RetrySettings struct {
+	Attempts       int     `json:"attempts"`        // retries after the first try
+	BackoffSeconds float64 `json:"backoff_seconds"` // delay before the first retry, doubled each time
+}
+
+func defaultRetrySettings() RetrySettings {
+	return RetrySettings{
+		Attempts:       3,
+		BackoffSeconds: 1,
+	}
+}
+
+// StatusError is returned when the camera answers with an unexpected HTTP status
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected response from camera: %s", e.Status)
+}
+
+// IsTransient reports whether an error is worth retrying: network hiccups,
+// connections dropped mid-transfer and server errors from the camera.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) || isNoSpace(err) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= 500
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		isConnectionLost(err) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// WithRetry runs fn, retrying transient failures with exponential backoff.
+// onRetry is called before each wait so callers can log the attempt.
+func WithRetry(ctx context.Context, settings RetrySettings, fn func() error, onRetry func(attempt int, delay time.Duration, err error)) error {
+	delay := time.Duration(settings.BackoffSeconds * float64(time.Second))
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > settings.Attempts || !IsTransient(err) || ctx.Err() != nil {
+			return err
+		}
+		if onRetry != nil {
+			onRetry(attempt, delay, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !plan9
+
+package lib
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isNoSpace reports whether err means the disk is full
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// isConnectionLost reports whether err comes from a connection that was
+// refused or dropped, or from an IO error reading the card
+func isConnectionLost(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.EIO)
+}
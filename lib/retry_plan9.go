@@ -0,0 +1,12 @@
+package lib
+
+// Plan 9 reports these as error strings rather than errno values, and network
+// errors are already caught as net.Error
+
+func isNoSpace(err error) bool {
+	return false
+}
+
+func isConnectionLost(err error) bool {
+	return false
+}
@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// DefaultPathTemplate mirrors the camera's folder layout
+const DefaultPathTemplate = "{camera_dir}/{file}"
+
+// Matches tokens such as {file} or {date:2006/01/02}
+var templateToken = regexp.MustCompile(`\{([a-z_]+)(?::([^}]*))?\}`)
+
+// checkPathTemplate rejects templates with unknown tokens or that could put
+// photos outside the download directory
+func checkPathTemplate(tmpl string) error {
+	for _, m := range templateToken.FindAllStringSubmatch(tmpl, -1) {
+		switch m[1] {
+		case "camera_dir", "file", "name", "ext", "model", "date":
+		default:
+			return fmt.Errorf("unknown token {%s}", m[1])
+		}
+	}
+	if path.IsAbs(tmpl) || filepath.IsAbs(tmpl) {
+		return fmt.Errorf("%q must be relative to download_dir", tmpl)
+	}
+	for _, part := range strings.FieldsFunc(tmpl, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return fmt.Errorf("%q must stay inside download_dir", tmpl)
+		}
+	}
+	return nil
+}
+
+// captureInfo is what we know about a photo beyond its name
+type captureInfo struct {
+	Time  time.Time
+	Model string
+	Size  int64
+	Photo PhotoInfo // the camera's own report, WiFi only
+}
+
+var (
+	captureCache   = make(map[string]captureInfo)
+	captureCacheMu sync.Mutex
+)
+
+// lookupCapture returns the capture time, camera model and size of a photo on the
+// camera. Results are cached since over WiFi each lookup is a request.
+func lookupCapture(name string, cfg Config) captureInfo {
+	info, _ := loadCapture(name, cfg)
+	return info
+}
+
+// loadCapture is lookupCapture, failing if the photo couldn't be read. Failed
+// lookups aren't cached so the next one tries again.
+func loadCapture(name string, cfg Config) (captureInfo, error) {
+	captureCacheMu.Lock()
+	info, ok := captureCache[name]
+	captureCacheMu.Unlock()
+	if ok {
+		return info, nil
+	}
+
+	switch cfg.ConnectionMethod {
+	case ConnectionMethodUSB:
+		srcPath := filepath.Join(cfg.UsbSettings.CameraDir, name)
+		if f, err := os.Open(srcPath); err == nil {
+			if x, err := exif.Decode(f); err == nil {
+				if t, err := x.DateTime(); err == nil {
+					info.Time = t
+				}
+				if tag, err := x.Get(exif.Model); err == nil {
+					info.Model, _ = tag.StringVal()
+				}
+			}
+			f.Close()
+		}
+		stat, err := os.Stat(srcPath)
+		if err != nil {
+			return info, err
+		}
+		info.Size = stat.Size()
+		// Fall back to the file's modification time
+		if info.Time.IsZero() {
+			info.Time = stat.ModTime()
+		}
+	case ConnectionMethodWiFi:
+		photoInfo, err := wifiGetPhotoInfo(name, cfg.Mock)
+		if err != nil {
+			return info, err
+		}
+		// The camera reports its local wall clock time
+		info.Time, _ = time.ParseInLocation("2006-01-02T15:04:05", photoInfo.Datetime, time.Local)
+		info.Model = photoInfo.CameraModel
+		info.Size = photoInfo.Size
+		info.Photo = photoInfo
+	}
+
+	captureCacheMu.Lock()
+	captureCache[name] = info
+	captureCacheMu.Unlock()
+	return info, nil
+}
+
+// forgetCapture drops cached details of a photo that is no longer on the camera
+func forgetCapture(name string) {
+	captureCacheMu.Lock()
+	delete(captureCache, name)
+	captureCacheMu.Unlock()
+}
+
+// ForgetCaptures drops everything cached about the camera's photos, e.g. once
+// it disconnects, as the next card may reuse the same names
+func ForgetCaptures() {
+	captureCacheMu.Lock()
+	captureCache = make(map[string]captureInfo)
+	captureCacheMu.Unlock()
+}
+
+// LocalPath returns where a camera photo is stored relative to the download
+// directory, using forward slashes, according to cfg.PathTemplate.
+func LocalPath(name string, cfg Config) string {
+	tmpl := cfg.PathTemplate
+	if tmpl == "" {
+		tmpl = DefaultPathTemplate
+	}
+
+	cameraDir, file := path.Split(name)
+	cameraDir = strings.TrimSuffix(cameraDir, "/")
+	ext := strings.TrimPrefix(path.Ext(file), ".")
+
+	// Only look up capture details when the template needs them
+	var info captureInfo
+	if strings.Contains(tmpl, "{date") || strings.Contains(tmpl, "{model") {
+		info = lookupCapture(name, cfg)
+	}
+
+	rel := templateToken.ReplaceAllStringFunc(tmpl, func(token string) string {
+		m := templateToken.FindStringSubmatch(token)
+		switch m[1] {
+		case "camera_dir":
+			return cameraDir
+		case "file":
+			return file
+		case "name":
+			return strings.TrimSuffix(file, path.Ext(file))
+		case "ext":
+			return ext
+		case "model":
+			if info.Model == "" {
+				return "unknown"
+			}
+			return strings.ReplaceAll(strings.TrimSpace(info.Model), "/", "_")
+		case "date":
+			if info.Time.IsZero() {
+				return "undated"
+			}
+			layout := m[2]
+			if layout == "" {
+				layout = "2006-01-02"
+			}
+			return info.Time.Format(layout)
+		}
+		return token
+	})
+
+	return path.Clean(strings.ReplaceAll(rel, "\\", "/"))
+}
+
+// DestPath returns the absolute path a camera photo is downloaded to
+func DestPath(name string, cfg Config) string {
+	return filepath.Join(cfg.DownloadDir, filepath.FromSlash(LocalPath(name, cfg)))
+}
@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// QuarantineDirName is the folder under the download directory where files
+// that fail verification are moved
+const QuarantineDirName = "quarantine"
+
+// VerifyDownload checks a finished transfer: its size must match what the
+// camera reported, USB copies can optionally be compared by SHA-256 with the
+// source, and the file must look like a valid JPEG or DNG.
+func VerifyDownload(name, dstPath string, expectedSize int64, cfg Config) error {
+	stat, err := os.Stat(dstPath)
+	if err != nil {
+		return err
+	}
+	if stat.Size() != expectedSize {
+		return fmt.Errorf("size mismatch: got %d bytes, camera reported %d", stat.Size(), expectedSize)
+	}
+
+	if cfg.ConnectionMethod == ConnectionMethodUSB && cfg.UsbSettings.VerifyChecksum {
+		srcSum, err := fileChecksum(filepath.Join(cfg.UsbSettings.CameraDir, name))
+		if err != nil {
+			return fmt.Errorf("couldn't checksum source: %v", err)
+		}
+		dstSum, err := fileChecksum(dstPath)
+		if err != nil {
+			return fmt.Errorf("couldn't checksum download: %v", err)
+		}
+		if !bytes.Equal(srcSum, dstSum) {
+			return fmt.Errorf("checksum mismatch")
+		}
+	}
+
+	return checkStructure(dstPath, stat.Size())
+}
+
+func fileChecksum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// checkStructure does a cheap sanity check of the file's header and trailer
+func checkStructure(path string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		header := make([]byte, 2)
+		if _, err := f.ReadAt(header, 0); err != nil || !bytes.Equal(header, []byte{0xFF, 0xD8}) {
+			return fmt.Errorf("missing JPEG start of image marker")
+		}
+		// The end of image marker may be followed by a little padding
+		tailLen := int64(1024)
+		if size < tailLen {
+			tailLen = size
+		}
+		tail := make([]byte, tailLen)
+		if _, err := f.ReadAt(tail, size-tailLen); err != nil || !bytes.Contains(tail, []byte{0xFF, 0xD9}) {
+			return fmt.Errorf("missing JPEG end of image marker, file is truncated")
+		}
+	case ".dng":
+		header := make([]byte, 8)
+		if _, err := f.ReadAt(header, 0); err != nil {
+			return fmt.Errorf("DNG header is too short")
+		}
+		var order binary.ByteOrder
+		switch {
+		case bytes.Equal(header[:4], []byte("II*\x00")):
+			order = binary.LittleEndian
+		case bytes.Equal(header[:4], []byte("MM\x00*")):
+			order = binary.BigEndian
+		default:
+			return fmt.Errorf("invalid DNG header")
+		}
+		if ifd := int64(order.Uint32(header[4:])); ifd < 8 || ifd >= size {
+			return fmt.Errorf("DNG directory offset is outside the file")
+		}
+	}
+	return nil
+}
+
+// QuarantineFile moves a download that failed verification into the quarantine
+// folder, keeping its camera path, and returns where it ended up.
+func QuarantineFile(path, name string, cfg Config) (string, error) {
+	dst := filepath.Join(cfg.DownloadDir, QuarantineDirName, name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	return dst, os.Rename(path, dst)
+}
@@ -7,17 +7,47 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	GRHost       = "http://192.168.0.1/"
-	PhotoListURI = "v1/photos"
-	PropsURI     = "v1/props"
+	DefaultGRHost = "http://192.168.0.1/"
+	PhotoListURI  = "v1/photos"
+	PropsURI      = "v1/props"
 )
 
+// The camera's base URL, it can be pointed elsewhere (e.g. a local stand-in
+// server) with the wifi.host config setting. Scans and downloads read it from
+// their own goroutines while the TUI switches configs.
+var (
+	grHost   = DefaultGRHost
+	grHostMu sync.RWMutex
+)
+
+// SetHost changes the camera's base URL, an empty host restores the default
+func SetHost(host string) {
+	if host == "" {
+		host = DefaultGRHost
+	}
+	if !strings.HasSuffix(host, "/") {
+		host += "/"
+	}
+	grHostMu.Lock()
+	grHost = host
+	grHostMu.Unlock()
+}
+
+// GRHost returns the camera's base URL
+func GRHost() string {
+	grHostMu.RLock()
+	defer grHostMu.RUnlock()
+	return grHost
+}
+
 func GRPhotoListURL() string {
-	return GRHost + PhotoListURI
+	return GRHost() + PhotoListURI
 }
 
 type GRPhotoList struct {
@@ -46,7 +76,9 @@ type PhotoInfo struct {
 	GpsInfo     string `json:"gpsInfo"`
 }
 
-func ScanCameraWiFi(out *[]string, mock bool) {
+// ScanCameraWiFi lists the photos on the camera. It fails if the camera can't
+// be reached or its answer can't be read.
+func ScanCameraWiFi(out *[]string, mock bool) error {
 
 	var data []byte
 
@@ -55,28 +87,30 @@ func ScanCameraWiFi(out *[]string, mock bool) {
 		mockFile := filepath.Join(currentDir, "mock", "photos.json")
 		data, err = os.ReadFile(mockFile)
 		if err != nil {
-			fmt.Println("Failed to read mock file:", err)
-			return
+			return fmt.Errorf("failed to read mock file: %w", err)
 		}
 	} else {
 		resp, err := http.Get(GRPhotoListURL())
 		if err != nil {
-			fmt.Println("Failed to connect to GR camera:", err)
-			return
+			return fmt.Errorf("failed to connect to GR camera: %w", err)
 		}
 		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return &StatusError{Code: resp.StatusCode, Status: resp.Status}
+		}
 
 		data, err = io.ReadAll(resp.Body)
 		if err != nil {
-			fmt.Println("Failed to read GR response:", err)
-			return
+			return fmt.Errorf("failed to read GR response: %w", err)
 		}
 	}
 
 	var photos GRPhotoList
 	if err := json.Unmarshal(data, &photos); err != nil {
-		fmt.Println("Failed to parse GR photo list:", err)
-		return
+		return fmt.Errorf("failed to parse GR photo list: %w", err)
+	}
+	if photos.ErrCode != 0 && photos.ErrCode != http.StatusOK {
+		return fmt.Errorf("camera couldn't list photos: %s (%d)", photos.ErrMsg, photos.ErrCode)
 	}
 
 	var names []string
@@ -88,9 +122,10 @@ func ScanCameraWiFi(out *[]string, mock bool) {
 	}
 
 	*out = names
+	return nil
 }
 
-func wifiGetPhotoInfo(name string, mock bool) PhotoInfo {
+func wifiGetPhotoInfo(name string, mock bool) (PhotoInfo, error) {
 	var info PhotoInfo
 
 	if mock {
@@ -100,25 +135,62 @@ func wifiGetPhotoInfo(name string, mock bool) PhotoInfo {
 		// simulate time delay for mock
 		time.Sleep(100 * time.Millisecond)
 		if err != nil {
-			fmt.Println("Failed to read mock file:", err)
-			return info
+			return info, fmt.Errorf("failed to read mock file: %w", err)
 		}
 		if err := json.Unmarshal(data, &info); err != nil {
-			fmt.Println("Failed to unmarshal mock data:", err)
+			return info, fmt.Errorf("failed to unmarshal mock data: %w", err)
 		}
-		return info
+		return info, nil
 	}
 
 	url := fmt.Sprintf("%s/%s/info", GRPhotoListURL(), name)
 	resp, err := http.Get(url)
 	if err != nil {
-		fmt.Println("HTTP error:", err)
-		return info
+		return info, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return info, &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
-		fmt.Println("Failed to decode response:", err)
+		return info, fmt.Errorf("failed to decode photo info: %w", err)
 	}
-	return info
+	return info, nil
+}
+
+// DeletePhotoWiFi removes a photo from the camera's card
+func DeletePhotoWiFi(name string, mock bool) error {
+	if mock {
+		// simulate time delay for mock
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}
+
+	url := fmt.Sprintf("%s/%s", GRPhotoListURL(), name)
+	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	// The camera reports errors in the body as well
+	var result struct {
+		ErrCode int    `json:"errCode"`
+		ErrMsg  string `json:"errMsg"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err == nil && result.ErrCode != 0 && result.ErrCode != http.StatusOK {
+		return fmt.Errorf("camera refused to delete %s: %s (%d)", name, result.ErrMsg, result.ErrCode)
+	}
+
+	forgetCapture(name)
+	return nil
 }
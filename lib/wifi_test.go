@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDeletePhotoWiFi(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{"deleted", http.StatusOK, `{"errCode": 200, "errMsg": "OK"}`, ""},
+		{"empty body", http.StatusOK, "", ""},
+		{"not found", http.StatusNotFound, `{"errCode": 404, "errMsg": "Not Found"}`, "404 Not Found"},
+		{"refused in the body", http.StatusOK, `{"errCode": 403, "errMsg": "Protected"}`, "camera refused to delete"},
+	}
+	defer SetHost("")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var method, path string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				method, path = r.Method, r.URL.Path
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+			SetHost(server.URL)
+
+			err := DeletePhotoWiFi("100RICOH/R0001234.DNG", false)
+			if method != http.MethodDelete || path != "/v1/photos/100RICOH/R0001234.DNG" {
+				t.Errorf("request = %s %s, want DELETE /v1/photos/100RICOH/R0001234.DNG", method, path)
+			}
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("DeletePhotoWiFi() error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("DeletePhotoWiFi() error = %v, want one containing %q", err, tt.wantErr)
+			}
+
+			var statusErr *StatusError
+			if isStatus := errors.As(err, &statusErr); isStatus != (tt.status != http.StatusOK) {
+				t.Errorf("DeletePhotoWiFi() error = %#v, want a *StatusError only for status %d", err, tt.status)
+			} else if isStatus && statusErr.Code != tt.status {
+				t.Errorf("StatusError.Code = %d, want %d", statusErr.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package lib
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tonytwostep/grsync-tui/assets"
+)
+
+// XmpSuffix is added to a photo's file name for its sidecar, e.g.
+// R0001234.DNG.xmp, so the JPEG and DNG of a pair each get their own
+const XmpSuffix = ".xmp"
+
+const tagsFileName = "grsync-tui-tags.json"
+
+// PhotoTags are set in the TUI and written to XMP sidecars
+type PhotoTags struct {
+	Rating   int      `json:"rating,omitempty"` // 0 to 5 stars
+	Keywords []string `json:"keywords,omitempty"`
+}
+
+// Tags are kept per shot so both files of a RAW+JPEG pair share them
+var (
+	photoTags   = make(map[string]PhotoTags)
+	photoTagsMu sync.Mutex
+	// Set when the tags file couldn't be read, so it isn't saved over
+	tagsLoadErr error
+)
+
+func tagsFilePath() string {
+	return filepath.Join(filepath.Dir(configFilePath()), tagsFileName)
+}
+
+// LoadTags reads the ratings and keywords saved by earlier runs
+func LoadTags() error {
+	data, err := os.ReadFile(tagsFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	photoTagsMu.Lock()
+	defer photoTagsMu.Unlock()
+	if err == nil {
+		err = json.Unmarshal(data, &photoTags)
+	}
+	if photoTags == nil {
+		photoTags = make(map[string]PhotoTags)
+	}
+	tagsLoadErr = err
+	return err
+}
+
+func tagKey(name string) string {
+	return strings.ToUpper(strings.TrimSuffix(name, path.Ext(name)))
+}
+
+// TagsFor returns the rating and keywords of a photo or photo group
+func TagsFor(name string) PhotoTags {
+	photoTagsMu.Lock()
+	defer photoTagsMu.Unlock()
+	return photoTags[tagKey(name)]
+}
+
+// SetTags sets the rating and keywords of a photo or photo group and saves
+// them to the tags file next to the config
+func SetTags(name string, tags PhotoTags) error {
+	photoTagsMu.Lock()
+	defer photoTagsMu.Unlock()
+	if tagsLoadErr != nil {
+		return fmt.Errorf("not saving over %s, it couldn't be read: %w", tagsFilePath(), tagsLoadErr)
+	}
+
+	key := tagKey(name)
+	old, had := photoTags[key]
+	if tags.Rating == 0 && len(tags.Keywords) == 0 {
+		delete(photoTags, key)
+	} else {
+		photoTags[key] = tags
+	}
+	if err := saveTags(); err != nil {
+		if had {
+			photoTags[key] = old
+		} else {
+			delete(photoTags, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// saveTags writes all tags, photoTagsMu must be held
+func saveTags() error {
+	path := tagsFilePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(photoTags, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + PartSuffix
+	if err := os.WriteFile(tmpPath, append(data, '\n'), 0600); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ParseKeywords splits a comma separated list, dropping blanks
+func ParseKeywords(value string) []string {
+	var keywords []string
+	for _, k := range strings.Split(value, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keywords = append(keywords, k)
+		}
+	}
+	return keywords
+}
+
+// WriteXmpSidecar writes an XMP sidecar next to a downloaded photo with the
+// shooting data reported by the camera, where it came from and the tags set
+// in the TUI. A sidecar written or changed by another program, such as an
+// editor, is left alone.
+func WriteXmpSidecar(name, localPath string, cfg Config) error {
+	sidecar := localPath + XmpSuffix
+	if !ownSidecar(sidecar) {
+		return fmt.Errorf("not replacing %s, it was written or changed by another program", sidecar)
+	}
+
+	info := lookupCapture(name, cfg)
+	importedAt := time.Now()
+	if rec, ok := lookupImport(name, cfg); ok {
+		importedAt = rec.ImportedAt
+	}
+	tags := TagsFor(name)
+	tool := "grsync-tui " + assets.Version
+
+	var b strings.Builder
+	b.WriteString("<?xpacket begin=\"\uFEFF\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	fmt.Fprintf(&b, "<x:xmpmeta xmlns:x=\"adobe:ns:meta/\" x:xmptk=\"%s\">\n", xmlEscape(tool))
+	b.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	b.WriteString("  <rdf:Description rdf:about=\"\"\n" +
+		"    xmlns:xmp=\"http://ns.adobe.com/xap/1.0/\"\n" +
+		"    xmlns:tiff=\"http://ns.adobe.com/tiff/1.0/\"\n" +
+		"    xmlns:exif=\"http://ns.adobe.com/exif/1.0/\"\n" +
+		"    xmlns:dc=\"http://purl.org/dc/elements/1.1/\"\n" +
+		"    xmlns:grsync=\"https://github.com/tonytwostep/grsync-tui/ns/1.0/\">\n")
+
+	prop := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "   <%s>%s</%s>\n", name, xmlEscape(value), name)
+		}
+	}
+
+	// Provenance
+	prop("xmp:CreatorTool", tool)
+	prop("tiff:Model", info.Model)
+	if !info.Time.IsZero() {
+		prop("xmp:CreateDate", info.Time.Format("2006-01-02T15:04:05"))
+		prop("exif:DateTimeOriginal", info.Time.Format("2006-01-02T15:04:05"))
+	}
+	prop("xmp:MetadataDate", time.Now().Format(time.RFC3339))
+	prop("grsync:CameraPath", name)
+	prop("grsync:ImportedAt", importedAt.Format(time.RFC3339))
+	prop("grsync:Version", assets.Version)
+
+	// Shooting data, only reported by the camera over WiFi
+	photo := info.Photo
+	prop("exif:FNumber", rational(strings.TrimPrefix(strings.ToUpper(photo.Av), "F")))
+	prop("exif:ExposureTime", exposureTime(photo.Tv))
+	prop("exif:ExposureBiasValue", rational(photo.Xv))
+	if iso := strings.TrimPrefix(strings.ToUpper(photo.Sv), "ISO"); iso != "" {
+		if _, err := strconv.Atoi(strings.TrimSpace(iso)); err == nil {
+			fmt.Fprintf(&b, "   <exif:ISOSpeedRatings>\n    <rdf:Seq>\n     <rdf:li>%s</rdf:li>\n    </rdf:Seq>\n   </exif:ISOSpeedRatings>\n", strings.TrimSpace(iso))
+		}
+	}
+	if lat, lon, ok := parseGps(photo.GpsInfo); ok {
+		prop("exif:GPSLatitude", gpsCoordinate(lat, "N", "S"))
+		prop("exif:GPSLongitude", gpsCoordinate(lon, "E", "W"))
+	}
+	prop("grsync:Av", photo.Av)
+	prop("grsync:Tv", photo.Tv)
+	prop("grsync:Sv", photo.Sv)
+	prop("grsync:Xv", photo.Xv)
+	prop("grsync:AspectRatio", photo.AspectRatio)
+	prop("grsync:GpsInfo", photo.GpsInfo)
+
+	// Tags from the TUI
+	if tags.Rating > 0 {
+		prop("xmp:Rating", strconv.Itoa(tags.Rating))
+	}
+	if len(tags.Keywords) > 0 {
+		b.WriteString("   <dc:subject>\n    <rdf:Bag>\n")
+		for _, k := range tags.Keywords {
+			fmt.Fprintf(&b, "     <rdf:li>%s</rdf:li>\n", xmlEscape(k))
+		}
+		b.WriteString("    </rdf:Bag>\n   </dc:subject>\n")
+	}
+
+	b.WriteString("  </rdf:Description>\n </rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"w\"?>\n")
+
+	// Write to a temporary file first so editors never read half a sidecar
+	tmp := sidecar + PartSuffix
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, sidecar)
+}
+
+// ownSidecar reports whether the sidecar at path is missing or was written by
+// grsync-tui. Editors rewrite the whole packet, which replaces the toolkit
+// name grsync-tui puts on it.
+func ownSidecar(path string) bool {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	decoder := xml.NewDecoder(f)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+		if el, ok := token.(xml.StartElement); ok {
+			for _, attr := range el.Attr {
+				if el.Name.Local == "xmpmeta" && attr.Name.Local == "xmptk" {
+					return strings.HasPrefix(attr.Value, "grsync-tui ")
+				}
+			}
+			return false
+		}
+	}
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// rational turns a decimal such as "2.8" or "-0.3" into an XMP rational
+func rational(value string) string {
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d/10", int(math.Round(f*10)))
+}
+
+// exposureTime accepts shutter speeds as a fraction ("1/250") or in seconds
+// ("2" or "2\"")
+func exposureTime(value string) string {
+	value = strings.TrimSpace(strings.TrimSuffix(value, "\""))
+	if value == "" {
+		return ""
+	}
+	if num, den, ok := strings.Cut(value, "/"); ok {
+		if _, err := strconv.Atoi(num); err != nil {
+			return ""
+		}
+		if _, err := strconv.Atoi(den); err != nil {
+			return ""
+		}
+		return value
+	}
+	return rational(value)
+}
+
+// parseGps reads a "latitude,longitude" pair in decimal degrees
+func parseGps(value string) (lat, lon float64, ok bool) {
+	latStr, lonStr, found := strings.Cut(value, ",")
+	if !found {
+		return 0, 0, false
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(latStr), 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	lon, err = strconv.ParseFloat(strings.TrimSpace(lonStr), 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+// gpsCoordinate formats decimal degrees the way XMP expects, e.g. "35,40.1234N"
+func gpsCoordinate(deg float64, pos, neg string) string {
+	ref := pos
+	if deg < 0 {
+		ref = neg
+		deg = -deg
+	}
+	whole := math.Floor(deg)
+	return fmt.Sprintf("%d,%.4f%s", int(whole), (deg-whole)*60, ref)
+}
@@ -1,31 +1,40 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
-	"github.com/rwcarlsen/goexif/exif"
 	"github.com/tonytwostep/grsync-tui/assets"
 	"github.com/tonytwostep/grsync-tui/lib"
-	"io"
-	"net/http"
-	"syscall"
 
-	"github.com/nfnt/resize"
-	"image/jpeg"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// Partial downloads older than this are deleted at startup
+const stalePartAge = 24 * time.Hour
+
 var (
 	app    *tview.Application
 	layout *tview.Flex
 	pages  = tview.NewPages()
 	cfg    lib.Config
 
+	// Config as read from the file, before the profile and flags are applied
+	fileCfg   lib.Config
+	overrides configFlags
+	// Set when the file couldn't be used and the defaults were chosen instead
+	brokenConfig bool
+
 	// Flexes
 	logoFlex *tview.Flex
 
@@ -35,15 +44,27 @@ var (
 	metadataBox   *tview.TextView
 	logoBox       *tview.TextView
 	logBox        *tview.TextView
+	queueBox      *tview.Table
 
 	// State
+	queue             *lib.Queue
+	moveAfterCopy     sync.Map // photos to delete from the card once downloaded
+	batchFiles        sync.Map // photos downloaded in the current batch, for the after_batch hook
 	photos            []string
+	groups            []lib.PhotoGroup // photos paired up by shot, one per list row
+	formatFilter      lib.FormatFilter
 	selected          = make(map[int]bool)
 	currentItem       int
 	existingFiles     = make(map[string]bool)
+	collisions        = make(map[string]bool) // photos whose name is taken locally by a different photo
 	termWidth         int
 	termHeight        int
 	lastMetadataIndex = -1
+	lastScan          = [2]int{-1, -1}   // photos and new photos in the last scan event
+	rescanCancel      context.CancelFunc // stops waiting for the camera of the previous config
+	configGen         int                // bumped when the config is switched, to drop stale scans
+	rescanning        bool               // the periodic scan waits while a switched config is scanned
+	deleting          int                // deletes from the camera still running
 )
 
 func itemIsSelected(index int) bool {
@@ -52,7 +73,7 @@ func itemIsSelected(index int) bool {
 }
 
 func updateMetadata(index int, forceReload bool) {
-	if index < 0 || index >= len(photos) {
+	if index < 0 || index >= len(groups) {
 		metadataBox.SetText("No photo selected")
 		return
 	}
@@ -61,37 +82,54 @@ func updateMetadata(index int, forceReload bool) {
 		return
 	}
 
-	name := photos[index]
+	group := groups[index]
+	name := group.Primary()
 	metadataBox.SetText("[yellow]Loading metadata...")
+	// Each file of a RAW+JPEG pair gets its own status
+	var statusMsg string
+	for _, file := range group.Files {
+		if existingFiles[file] {
+			statusMsg += fmt.Sprintf("\n  [white]%s: [green]Downloaded 💾", path.Base(file))
+		} else if collisions[file] {
+			statusMsg += fmt.Sprintf("\n  [white]%s: [yellow]Not downloaded, name taken by a different photo ⚠", path.Base(file))
+		} else {
+			statusMsg += fmt.Sprintf("\n  [white]%s: [red]Not downloaded", path.Base(file))
+		}
+	}
+	// The loader only sees this copy of the config, applyConfig may replace it meanwhile
+	c, downloaded := cfg, existingFiles[name]
 	go func(photoName string, idx int) {
-		size, modTime, exists := lib.GetFileInfo(photoName, cfg, existingFiles)
+		size, modTime, exists := lib.GetFileInfo(photoName, c, map[string]bool{photoName: downloaded})
 		sizeStr := "N/A"
 		dateStr := "N/A"
 		if exists {
 			sizeStr = fmt.Sprintf("%.2f MB", float64(size)/(1024*1024))
 			dateStr = modTime.Format("2006-01-02 15:04:05")
 		}
-		var statusMsg string
-		if existingFiles[photoName] {
-			statusMsg = "[green]Downloaded 💾"
-		} else {
-			statusMsg = "[red]Not downloaded"
+		tags := lib.TagsFor(group.Base)
+		rating := "-"
+		if tags.Rating > 0 {
+			rating = strings.Repeat("★", tags.Rating)
+		}
+		keywords := "-"
+		if len(tags.Keywords) > 0 {
+			keywords = tview.Escape(strings.Join(tags.Keywords, ", "))
 		}
 		// Only extract EXIF if local file exists
 		var exifInfo interface{}
 		if exists {
-			exifInfo = lib.ExtractExifInfo(photoName, cfg)
+			exifInfo = lib.ExtractExifInfo(photoName, c)
 		}
 		app.QueueUpdateDraw(func() {
 			// Only update if still on the same photo
 			if currentItem == idx {
 				metadataInfo := fmt.Sprintf(
-					"[white]File:[yellow] %s\n[white]Filesize:[yellow] %s\n[white]Date:[yellow] %s\n\n%s\n[white]Status: %s",
-					photoName, sizeStr, dateStr, exifInfo, statusMsg)
+					"[white]File:[yellow] %s\n[white]Formats:[yellow] %s\n[white]Filesize:[yellow] %s\n[white]Captured:[yellow] %s\n[white]Rating:[yellow] %s\n[white]Keywords:[yellow] %s\n\n%s\n[white]Status: %s",
+					photoName, group.Formats(), sizeStr, dateStr, rating, keywords, exifInfo, statusMsg)
 				metadataBox.SetText(metadataInfo)
 			}
+			lastMetadataIndex = idx
 		})
-		lastMetadataIndex = idx
 	}(name, index)
 }
 
@@ -104,6 +142,38 @@ func errorPreviewModal(msg string) *tview.Modal {
 		})
 }
 
+// showConfigError lists the problems with the config before the TUI starts
+// and returns the button the user picked. The config file is left alone
+// unless they choose to reset it.
+func showConfigError(cfgErr *lib.ConfigError) string {
+	var choice string
+	errApp := tview.NewApplication()
+
+	problems := tview.NewTextView().SetDynamicColors(true).SetWordWrap(true)
+	fmt.Fprintf(problems, "[red]Problems with %s:[white]\n\n", tview.Escape(cfgErr.Path))
+	for _, problem := range cfgErr.Problems {
+		fmt.Fprintf(problems, "  • %s\n", tview.Escape(problem))
+	}
+	fmt.Fprint(problems, "\nFix them and start grsync-tui again, reset the file to the defaults (the old one is kept as a .bak), or use the defaults for now (saving settings keeps the old file as a .bak too).")
+
+	buttons := tview.NewForm().SetButtonsAlign(tview.AlignCenter)
+	for _, label := range []string{"Quit", "Reset to defaults", "Use defaults"} {
+		buttons.AddButton(label, func() {
+			choice = label
+			errApp.Stop()
+		})
+	}
+
+	screen := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(problems, 0, 1, false).
+		AddItem(buttons, 3, 0, true)
+	screen.SetBorder(true).SetTitle(" Config problems ")
+	if err := errApp.SetRoot(screen, true).Run(); err != nil {
+		fmt.Println(cfgErr)
+	}
+	return choice
+}
+
 func setAppFocus(t *tview.TextView, l *tview.List) {
 	if t != nil {
 		app.SetFocus(t)
@@ -113,63 +183,9 @@ func setAppFocus(t *tview.TextView, l *tview.List) {
 }
 
 func renderPreviewModal(photoName string) tview.Primitive {
-	var file io.ReadCloser
-	var err error
-
-	// Check if the photo exists in the download directory first
-	if existingFiles[photoName] {
-		path := filepath.Join(cfg.DownloadDir, photoName)
-		file, err = os.Open(path)
-		if err != nil {
-			return errorPreviewModal("Failed to open downloaded file.")
-		}
-	} else {
-		switch cfg.ConnectionMethod {
-		case lib.ConnectionMethodUSB:
-			path := filepath.Join(cfg.UsbSettings.CameraDir, photoName)
-			file, err = os.Open(path)
-			if err != nil {
-				return errorPreviewModal("Failed to open local file.")
-			}
-			defer file.Close()
-		case lib.ConnectionMethodWiFi:
-			url := lib.GRHost + "v1/photos/" + photoName + "?size=view"
-			resp, err := http.Get(url)
-			if err != nil || resp.StatusCode != http.StatusOK {
-				return errorPreviewModal("Failed to fetch image from camera.")
-			}
-			file = resp.Body
-			defer file.Close()
-		default:
-			fmt.Errorf("Unknown connection method specified, check config: %s", cfg.ConnectionMethod)
-			syscall.Exit(1)
-		}
-	}
-
-	buf := new(bytes.Buffer)
-	_, err = buf.ReadFrom(file)
-
-	if err != nil {
-		return errorPreviewModal("Failed to read image.")
-	}
-
-	img, err := jpeg.Decode(buf)
+	img, err := lib.LoadPreview(photoName, existingFiles[photoName], cfg)
 	if err != nil {
-		return errorPreviewModal("Failed to decode image.")
-	}
-
-	// Usb lets resize the image to speed things up (not necessary for wifi)
-	const previewMax = 320
-	img = resize.Thumbnail(previewMax, previewMax, img, resize.Lanczos3)
-
-	// Exif stuff
-	x, err := exif.Decode(bytes.NewReader(buf.Bytes()))
-
-	if err == nil {
-		if orientTag, err := x.Get(exif.Orientation); err == nil {
-			orient, _ := orientTag.Int(0)
-			img = lib.ApplyOrientation(img, orient)
-		}
+		return errorPreviewModal(fmt.Sprintf("Couldn't load preview: %v", err))
 	}
 
 	w, h := termWidth, termHeight
@@ -237,10 +253,35 @@ func renderPreviewModal(photoName string) tview.Primitive {
 func updatePhotoList() {
 	prevItem := photoListBox.GetCurrentItem()
 	photoListBox.Clear()
-	for i, name := range photos {
-		displayName := name
-		if existingFiles[name] {
+	for i, group := range groups {
+		displayName := fmt.Sprintf("%s [%s[]", group.Base, group.Formats())
+		downloaded, queued := 0, false
+		files := group.Filtered(formatFilter)
+		for _, name := range files {
+			if existingFiles[name] {
+				downloaded++
+			} else if state, ok := queue.State(name); ok && (state == lib.QueuePending || state == lib.QueueActive) {
+				queued = true
+			}
+		}
+		clash := false
+		for _, name := range files {
+			clash = clash || collisions[name]
+		}
+		switch {
+		case len(files) > 0 && downloaded == len(files):
 			displayName = "💾 " + displayName
+		case queued:
+			displayName = "⏳ " + displayName
+		case clash:
+			// Same name as a different photo that is already downloaded
+			displayName = "⚠ " + displayName
+		case downloaded > 0:
+			// Only part of a RAW+JPEG pair is downloaded
+			displayName = "◐ " + displayName
+		}
+		if rating := lib.TagsFor(group.Base).Rating; rating > 0 {
+			displayName += " " + strings.Repeat("★", rating)
 		}
 		if selected[i] {
 			displayName = fmt.Sprintf("[green]%s", displayName)
@@ -257,29 +298,43 @@ func updatePhotoList() {
 	currentItem = photoListBox.GetCurrentItem()
 }
 
-func downloadSelected() {
-	var files []string
+// selectedRows returns the selected rows in order, or the current one if
+// nothing is selected
+func selectedRows() []int {
+	rows := make([]int, 0, len(selected))
 	for i := range selected {
-		name := photos[i]
-		if !existingFiles[name] {
-			files = append(files, name)
+		if i >= 0 && i < len(groups) {
+			rows = append(rows, i)
 		}
 	}
+	// If there is no selection, use the current item
+	if len(selected) == 0 && currentItem >= 0 && currentItem < len(groups) {
+		rows = append(rows, currentItem)
+	}
+	sort.Ints(rows)
+	return rows
+}
 
-	// If there is no selection, download the current item if it exists and is not already downloaded
-	if len(selected) == 0 {
-		if currentItem >= 0 && currentItem < len(photos) {
-			name := photos[currentItem]
-			if !existingFiles[name] {
+// selectedFiles returns the files of the selected photos, or of the current one
+// if nothing is selected, limited by the format filter. Already downloaded files
+// are left out unless includeDownloaded is set.
+func selectedFiles(includeDownloaded bool) []string {
+	var files []string
+	for _, i := range selectedRows() {
+		for _, name := range groups[i].Filtered(formatFilter) {
+			if includeDownloaded || !existingFiles[name] {
 				files = append(files, name)
 			}
 		}
 	}
+	return files
+}
 
-	total := len(files)
+func downloadSelected() {
+	files := selectedFiles(false)
 
 	// No new files to download
-	if total == 0 {
+	if len(files) == 0 {
 		modal := tview.NewModal().
 			SetText("[red]Selection is already downloaded.").
 			AddButtons([]string{"OK"}).
@@ -290,123 +345,488 @@ func downloadSelected() {
 		return
 	}
 
-	// Show progress modal
-	progressModal := tview.NewModal().
-		AddButtons([]string{"Cancel"}).
-		SetDoneFunc(func(buttonIndex int, buttonLabel string) {
-			pages.RemovePage("modal")
-		})
-
-	// Unicode blocks for smooth progress bar (8 levels)
-	barBlocks := []rune{' ', '▏', '▎', '▍', '▌', '▋', '▊', '▉', '█'}
-
-	// Returns a smooth unicode progress bar string
-	smoothBar := func(current, total, barLen int) string {
-		if total == 0 {
-			return "[" + strings.Repeat(" ", barLen) + "]"
+	preflight(files, func(files []string) {
+		// A plain download never deletes from the card
+		for _, name := range files {
+			moveAfterCopy.Delete(name)
 		}
-		progress := float64(current) / float64(total)
-		fullBlocks := int(progress * float64(barLen))
-		partialBlockFrac := (progress*float64(barLen) - float64(fullBlocks)) * 8
-		partialBlock := int(partialBlockFrac + 0.5) // round to nearest
+		added := queue.Add(files...)
+		lib.WriteLog(fmt.Sprintf("[yellow]%s - Queued %d photos for download", time.Now().Format("2006-01-02 15:04:05"), added))
+		deselectQueued()
+	})
+}
 
-		bar := strings.Repeat(string(barBlocks[8]), fullBlocks)
-		if fullBlocks < barLen && partialBlock > 0 {
-			bar += string(barBlocks[partialBlock])
-			fullBlocks++
+// deselectQueued clears the selection of rows that are now downloaded or
+// queued, so more photos can be picked while they download
+func deselectQueued() {
+	for i := range selected {
+		if i >= len(groups) {
+			delete(selected, i)
+			continue
 		}
-		if fullBlocks < barLen {
-			bar += strings.Repeat(" ", barLen-fullBlocks)
+		done := true
+		for _, name := range groups[i].Filtered(formatFilter) {
+			state, ok := queue.State(name)
+			if !existingFiles[name] && !(ok && (state == lib.QueuePending || state == lib.QueueActive)) {
+				done = false
+			}
+		}
+		if done {
+			delete(selected, i)
 		}
-		return "[" + bar + "]"
 	}
+	updatePhotoList()
+	updatePhotoCount()
+	updateQueueBox()
+	updateLogBox()
+}
 
-	updateModal := func(current int, filename string) {
-		percent := int(float64(current) / float64(total) * 100)
-		barLen := 30
-		bar := smoothBar(current, total, barLen)
-		text := fmt.Sprintf(
-			"[yellow]Downloading %d photos...\n[white]%s\n[green]%s %3d%% (%d/%d)",
-			total, filename, bar, percent, current, total,
-		)
-		progressModal.SetText(text)
+// preflight checks that the download directory has room for files on top of
+// what is already queued before handing them to enqueue. If they don't fit,
+// the user can download the ones that do or go back and trim the selection.
+func preflight(files []string, enqueue func(files []string)) {
+	// Already downloaded (move only) or queued photos need no extra space. The
+	// check runs on a copy of the config, applyConfig may replace it meanwhile.
+	c := cfg
+	extra := make([]bool, len(files))
+	for i, name := range files {
+		state, ok := queue.State(name)
+		extra[i] = !existingFiles[name] && !(ok && (state == lib.QueuePending || state == lib.QueueActive))
 	}
 
-	pages.AddPage("modal", progressModal, true, true)
-
-	queueStart := time.Now()
 	go func() {
-		for i, file := range files {
-			srcPath := filepath.Join(cfg.UsbSettings.CameraDir, file)
-			dstPath := filepath.Join(cfg.DownloadDir, file)
+		sizes := make([]int64, len(files))
+		var need int64
+		for i, name := range files {
+			if extra[i] {
+				sizes[i] = lib.SourceSize(name, c)
+				need += sizes[i]
+			}
+		}
+		// The queue sizes its items when it gets to them, so look up the
+		// ones it hasn't yet
+		var queued int64
+		for _, item := range queue.Items() {
+			switch {
+			case item.State == lib.QueueActive:
+				queued += item.Size - item.Done
+			case item.State == lib.QueuePending && item.Size > 0:
+				queued += item.Size
+			case item.State == lib.QueuePending:
+				queued += lib.SourceSize(item.Name, c)
+			}
+		}
+		free, err := lib.FreeSpace(c.DownloadDir)
 
-			app.QueueUpdateDraw(func() {
-				updateModal(i+1, file)
+		app.QueueUpdateDraw(func() {
+			if err != nil {
+				lib.WriteLog(fmt.Sprintf("[yellow]%s - Couldn't check free space in %s: %v", time.Now().Format("2006-01-02 15:04:05"), c.DownloadDir, err))
+				enqueue(files)
+				return
+			}
+			if need+queued <= int64(free) {
+				enqueue(files)
+				return
+			}
+
+			// Keep photos in order while they still fit
+			budget := int64(free) - queued
+			var fits []string
+			for i, name := range files {
+				if sizes[i] <= budget {
+					fits = append(fits, name)
+					budget -= sizes[i]
+				}
+			}
+
+			buttons := []string{"Trim selection"}
+			if len(fits) > 0 {
+				buttons = []string{"Download what fits", "Trim selection"}
+			}
+			modal := tview.NewModal().
+				SetText(fmt.Sprintf("[red]Not enough free space in %s\n[white]Needed: %s (%s already queued)\nAvailable: %s\nShort by: [red]%s\n[white]%d of %d photos fit.",
+					c.DownloadDir, formatMB(need+queued), formatMB(queued), formatMB(int64(free)), formatMB(need+queued-int64(free)), len(fits), len(files))).
+				AddButtons(buttons).
+				SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+					pages.RemovePage("modal")
+					if buttonLabel == "Download what fits" {
+						enqueue(fits)
+					}
+				})
+			pages.AddPage("modal", modal, true, true)
+		})
+	}()
+}
+
+// moveSelected downloads the selection and deletes each photo from the card
+// once its copy is verified. Photos that are already downloaded are only deleted.
+func moveSelected() {
+	if cfg.ConnectionMethod != lib.ConnectionMethodUSB {
+		modal := tview.NewModal().
+			SetText("[red]Moving photos is only available over USB.").
+			AddButtons([]string{"OK"}).
+			SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+				pages.RemovePage("modal")
 			})
+		pages.AddPage("modal", modal, true, true)
+		return
+	}
 
-			perFileStart := time.Now()
+	files := selectedFiles(true)
+	if len(files) == 0 {
+		return
+	}
 
-			switch cfg.ConnectionMethod {
-			case lib.ConnectionMethodUSB:
-				lib.WriteLog(fmt.Sprintf("[yellow]%s - Local download %s", time.Now().Format("2006-01-02 15:04:05"), srcPath), logBox)
-				if err := lib.CopyFile(srcPath, dstPath); err != nil {
-					lib.WriteLog(fmt.Sprintf("[red]%s - Failed to download %s: %v", time.Now().Format("2006-01-02 15:04:05"), file, err), logBox)
-					continue
-				}
-			case lib.ConnectionMethodWiFi:
-				// Download from camera via WiFi
-				lib.WriteLog(fmt.Sprintf("[yellow]%s - WiFi download %s", time.Now().Format("2006-01-02 15:04:05"), srcPath), logBox)
-				url := fmt.Sprintf("%s/%s", lib.GRPhotoListURL(), file)
-				resp, err := http.Get(url)
-				if err != nil {
-					lib.WriteLog(fmt.Sprintf("[red]%s - Failed to download %s: %v", time.Now().Format("2006-01-02 15:04:05"), file, err), logBox)
-					continue
+	modal := tview.NewModal().
+		SetText(fmt.Sprintf("[yellow]Move %d photos?\n[white]Each photo is deleted from the card once its copy has been verified.", len(files))).
+		AddButtons([]string{"Move", "Cancel"}).
+		SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+			pages.RemovePage("modal")
+			if buttonLabel != "Move" {
+				return
+			}
+			preflight(files, func(files []string) {
+				for _, name := range files {
+					moveAfterCopy.Store(name, true)
 				}
-				defer resp.Body.Close()
+				added := queue.Add(files...)
+				lib.WriteLog(fmt.Sprintf("[yellow]%s - Queued %d photos to move off the card", time.Now().Format("2006-01-02 15:04:05"), added))
+				deselectQueued()
+			})
+		})
+	pages.AddPage("modal", modal, true, true)
+}
 
-				err = os.MkdirAll(filepath.Dir(dstPath), os.ModePerm)
-				if err != nil {
-					lib.WriteLog(fmt.Sprintf("[red]%s - Couldn't mkdir %s: %v", time.Now().Format("2006-01-02 15:04:05"), file, err), logBox)
-				}
-				out, err := os.Create(dstPath)
-				if err != nil {
-					lib.WriteLog(fmt.Sprintf("[red]%s - Failed to download  %s: %v", time.Now().Format("2006-01-02 15:04:05"), file, err), logBox)
-					continue
-				}
-				defer out.Close()
+// deleteSelected removes the selection from the camera over WiFi after asking
+// for confirmation. Photos can be limited to the ones already imported.
+func deleteSelected() {
+	if cfg.ConnectionMethod != lib.ConnectionMethodWiFi {
+		modal := tview.NewModal().
+			SetText("[red]Deleting photos is only available over WiFi, use m to move photos off the card over USB.").
+			AddButtons([]string{"OK"}).
+			SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+				pages.RemovePage("modal")
+			})
+		pages.AddPage("modal", modal, true, true)
+		return
+	}
 
-				if _, err := io.Copy(out, resp.Body); err != nil {
-					lib.WriteLog(fmt.Sprintf("[red]%s - Failed to download %s: %v", time.Now().Format("2006-01-02 15:04:05"), file, err), logBox)
-					continue
+	files := selectedFiles(true)
+	if len(files) == 0 {
+		return
+	}
+	imported := 0
+	for _, name := range files {
+		if existingFiles[name] {
+			imported++
+		}
+	}
+
+	modal := tview.NewModal().
+		SetText(fmt.Sprintf("[red]Delete %d photos from the camera?\n[white]%d of them have been imported. This can't be undone.", len(files), imported)).
+		AddButtons([]string{"Delete imported only", "Delete all", "Cancel"}).
+		SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+			pages.RemovePage("modal")
+			var toDelete []string
+			switch buttonLabel {
+			case "Delete imported only":
+				for _, name := range files {
+					if existingFiles[name] {
+						toDelete = append(toDelete, name)
+					}
 				}
+			case "Delete all":
+				toDelete = files
 			default:
-				fmt.Errorf("Unknown connection method specified, check config: %s", cfg.ConnectionMethod)
-				syscall.Exit(1)
+				return
 			}
+			selected = make(map[int]bool)
+			deleting++
+			go deleteFromCamera(toDelete, cfg.Mock)
+		})
+	pages.AddPage("modal", modal, true, true)
+}
 
-			elapsed := time.Since(perFileStart).Seconds()
-			lib.WriteLog(fmt.Sprintf("[purple]%s - Downloaded %s in %.2f seconds", time.Now().Format("2006-01-02 15:04:05"), file, elapsed), logBox)
-
-			existingFiles[file] = true
+// deleteFromCamera deletes photos over WiFi and refreshes the list afterwards.
+// It runs off the UI goroutine, so it's given what it needs from the config.
+func deleteFromCamera(files []string, mock bool) {
+	deleted := 0
+	for _, name := range files {
+		if state, ok := queue.State(name); ok && (state == lib.QueuePending || state == lib.QueueActive) {
+			lib.WriteLog(fmt.Sprintf("[red]%s - Kept %s on the camera, it is queued for download", time.Now().Format("2006-01-02 15:04:05"), name))
+			continue
 		}
-		app.QueueUpdateDraw(func() {
-			progressModal.SetText("[green]Download complete!")
-			progressModal.AddButtons([]string{"OK"})
-			lib.ScanDownloadDir(existingFiles, cfg)
-			updatePhotoList()
-			updateMetadata(currentItem, true)
-			totalElapsed := time.Since(queueStart).Seconds()
+		if err := lib.DeletePhotoWiFi(name, mock); err != nil {
+			lib.WriteLog(fmt.Sprintf("[red]%s - Failed to delete %s from the camera: %v", time.Now().Format("2006-01-02 15:04:05"), name, err))
+			continue
+		}
+		lib.WriteLog(fmt.Sprintf("[purple]%s - Deleted %s from the camera", time.Now().Format("2006-01-02 15:04:05"), name))
+		deleted++
+	}
+	if len(files) > 1 {
+		lib.WriteLog(fmt.Sprintf("[blue]%s - Deleted %d of %d photos from the camera", time.Now().Format("2006-01-02 15:04:05"), deleted, len(files)))
+	}
+
+	app.QueueUpdate(func() {
+		deleting--
+	})
+	refreshPhotos()
+}
+
+// retryFailed re-queues exactly the photos that failed in the last batch
+func retryFailed() {
+	if queue.RetryFailed() == 0 {
+		modal := tview.NewModal().
+			SetText("[yellow]Nothing failed in the last batch.").
+			AddButtons([]string{"OK"}).
+			SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+				pages.RemovePage("modal")
+			})
+		pages.AddPage("modal", modal, true, true)
+	}
+}
+
+// cancelQueue aborts the active download and drops everything pending. The
+// unfinished photos are selected again so the batch can be restarted.
+func cancelQueue() {
+	progress := queue.Progress()
+	cancelled := queue.CancelAll()
+	if len(cancelled) == 0 {
+		return
+	}
+	lib.WriteLog(fmt.Sprintf("[red]%s - Download cancelled after %d of %d photos", time.Now().Format("2006-01-02 15:04:05"), progress.FilesDone, progress.Files))
 
-			// If the queue was longer than one
-			if total > 1 {
-				lib.WriteLog(fmt.Sprintf("[blue]%s - Downloaded %d photos in %.2f seconds", time.Now().Format("2006-01-02 15:04:05"), total, totalElapsed), logBox)
+	unfinished := make(map[string]bool)
+	for _, name := range cancelled {
+		unfinished[name] = true
+	}
+	for i, group := range groups {
+		for _, name := range group.Files {
+			if unfinished[name] {
+				selected[i] = true
 			}
-			updateLogBox()
-		})
+		}
+	}
+	updatePhotoList()
+	updatePhotoCount()
+	updateLogBox()
+}
 
-		// Selected items are cleared after download
-		selected = make(map[int]bool)
-	}()
+func togglePause() {
+	queue.SetPaused(!queue.Paused())
+	if queue.Paused() {
+		lib.WriteLog(fmt.Sprintf("[yellow]%s - Download queue paused", time.Now().Format("2006-01-02 15:04:05")))
+	} else {
+		lib.WriteLog(fmt.Sprintf("[yellow]%s - Download queue resumed", time.Now().Format("2006-01-02 15:04:05")))
+	}
+	updateLogBox()
+}
+
+// transferPhoto downloads a single photo for the queue and, for moves,
+// deletes it from the card afterwards
+func transferPhoto(ctx context.Context, file string, onProgress lib.ProgressFunc) error {
+	_, move := moveAfterCopy.Load(file)
+
+	// Photos that are only being moved off the card don't need copying again
+	var downloaded bool
+	app.QueueUpdate(func() {
+		downloaded = existingFiles[file]
+	})
+	if move && downloaded {
+		return deleteFromCard(file, lib.ImportedPath(file, cfg))
+	}
+
+	dstPath, err := lib.ImportPhoto(ctx, file, cfg, onProgress, tuiLog)
+	if err != nil {
+		if ctx.Err() != nil {
+			// A cancelled move shouldn't delete anything on a later download
+			moveAfterCopy.Delete(file)
+		}
+		return err
+	}
+	batchFiles.Store(file, lib.NewHookFile(file, dstPath, cfg))
+
+	if move {
+		return deleteFromCard(file, dstPath)
+	}
+	return nil
+}
+
+// tuiLog writes import messages to the log panel
+func tuiLog(level lib.LogLevel, message string) {
+	color := "yellow"
+	switch level {
+	case lib.LogOutput:
+		color = "white"
+		message = tview.Escape(message)
+	case lib.LogError:
+		color = "red"
+	case lib.LogDone:
+		color = "purple"
+	}
+	lib.WriteLog(fmt.Sprintf("[%s]%s - %s", color, time.Now().Format("2006-01-02 15:04:05"), message))
+}
+
+// deleteFromCard removes a moved photo from the card and refreshes the list
+func deleteFromCard(file, localPath string) error {
+	moveAfterCopy.Delete(file)
+	if err := lib.DeleteFromCard(file, localPath, cfg); err != nil {
+		lib.WriteLog(fmt.Sprintf("[red]%s - Kept %s on the card: %v", time.Now().Format("2006-01-02 15:04:05"), file, err))
+		return err
+	}
+	lib.WriteLog(fmt.Sprintf("[purple]%s - Deleted %s from the card", time.Now().Format("2006-01-02 15:04:05"), file))
+
+	refreshPhotos()
+	return nil
+}
+
+// onQueueIdle wraps up a finished batch
+func onQueueIdle(batch []lib.QueueItem, elapsed time.Duration) {
+	var done, skipped, failed int
+	var bytes int64
+	for _, item := range batch {
+		switch item.State {
+		case lib.QueueDone:
+			done++
+			bytes += item.Size
+		case lib.QueueSkipped:
+			skipped++
+		case lib.QueueFailed:
+			failed++
+		}
+	}
+	lib.EmitBatch(len(batch), done, skipped, failed, bytes, elapsed)
+
+	// If the queue was longer than one
+	if len(batch) > 1 {
+		lib.WriteLog(fmt.Sprintf("[blue]%s - Downloaded %d photos in %.2f seconds", time.Now().Format("2006-01-02 15:04:05"), done, elapsed.Seconds()))
+	}
+	if skipped > 0 {
+		lib.WriteLog(fmt.Sprintf("[yellow]%s - Skipped %d photos whose names are taken by different ones, see collision_policy", time.Now().Format("2006-01-02 15:04:05"), skipped))
+	}
+	if failed > 0 {
+		lib.WriteLog(fmt.Sprintf("[red]%s - %d of %d photos failed, press r to retry them", time.Now().Format("2006-01-02 15:04:05"), failed, len(batch)))
+	}
+
+	var files []lib.HookFile
+	for _, item := range batch {
+		if f, ok := batchFiles.LoadAndDelete(item.Name); ok && item.State == lib.QueueDone {
+			files = append(files, f.(lib.HookFile))
+		}
+	}
+	if len(files) > 0 {
+		lib.LogHook("after_batch", lib.RunAfterBatchHook(files, cfg), tuiLog)
+	}
+
+	refreshPhotos()
+}
+
+// Unicode blocks for smooth progress bar (8 levels)
+var barBlocks = []rune{' ', '▏', '▎', '▍', '▌', '▋', '▊', '▉', '█'}
+
+// Returns a smooth unicode progress bar string
+func smoothBar(current, total, barLen int) string {
+	if total == 0 {
+		return "[" + strings.Repeat(" ", barLen) + "]"
+	}
+	progress := float64(current) / float64(total)
+	fullBlocks := int(progress * float64(barLen))
+	partialBlockFrac := (progress*float64(barLen) - float64(fullBlocks)) * 8
+	partialBlock := int(partialBlockFrac + 0.5) // round to nearest
+
+	bar := strings.Repeat(string(barBlocks[8]), fullBlocks)
+	if fullBlocks < barLen && partialBlock > 0 {
+		bar += string(barBlocks[partialBlock])
+		fullBlocks++
+	}
+	if fullBlocks < barLen {
+		bar += strings.Repeat(" ", barLen-fullBlocks)
+	}
+	return "[" + bar + "]"
+}
+
+func updateQueueBox() {
+	items := queue.Items()
+	progress := queue.Progress()
+
+	// Batch progress, throughput and ETA go in the title
+	title := "Queue"
+	if progress.Files > 0 {
+		rate := 0.0
+		eta := "--"
+		if elapsed := time.Since(progress.Started).Seconds(); elapsed > 0 {
+			rate = float64(progress.BytesDone) / elapsed
+		}
+		if rate > 0 && progress.Bytes > progress.BytesDone {
+			eta = (time.Duration(float64(progress.Bytes-progress.BytesDone)/rate) * time.Second).Round(time.Second).String()
+		}
+		title = fmt.Sprintf("Queue %d/%d - %s / %s - %.1f MB/s - ETA %s",
+			progress.FilesDone, progress.Files, formatMB(progress.BytesDone), formatMB(progress.Bytes), rate/(1024*1024), eta)
+	}
+	if queue.Paused() {
+		title += " [paused]"
+	}
+	queueBox.SetTitle(title)
+
+	row, _ := queueBox.GetSelection()
+	queueBox.Clear()
+	if len(items) == 0 {
+		queueBox.SetCell(0, 0, tview.NewTableCell("[yellow]Nothing queued, press d to download photos.").SetSelectable(false))
+		return
+	}
+	for i, item := range items {
+		var state, detail string
+		switch item.State {
+		case lib.QueuePending:
+			state = "[white]pending"
+			detail = formatMB(item.Size)
+		case lib.QueueActive:
+			state = "[yellow]active"
+			detail = fmt.Sprintf("%s %s / %s", smoothBar(int(item.Done/1024), int(item.Size/1024), 20), formatMB(item.Done), formatMB(item.Size))
+		case lib.QueueDone:
+			state = "[green]done"
+			detail = formatMB(item.Size)
+		case lib.QueueFailed:
+			state = "[red]failed"
+			detail = tview.Escape(item.Err.Error())
+		case lib.QueueCancelled:
+			state = "[purple]cancelled"
+		case lib.QueueSkipped:
+			state = "[yellow]skipped"
+			detail = tview.Escape(item.Err.Error())
+		}
+		queueBox.SetCell(i, 0, tview.NewTableCell(state))
+		queueBox.SetCell(i, 1, tview.NewTableCell("[white]"+item.Name))
+		queueBox.SetCell(i, 2, tview.NewTableCell("[white]"+detail).SetExpansion(1))
+	}
+	if row >= len(items) {
+		row = len(items) - 1
+	}
+	queueBox.Select(row, 0)
+}
+
+// moveQueueItem reorders the highlighted queue item
+func moveQueueItem(direction lib.Direction) {
+	row, _ := queueBox.GetSelection()
+	row = queue.Move(row, int(direction))
+	updateQueueBox()
+	queueBox.Select(row, 0)
+}
+
+func cancelQueueItem() {
+	row, _ := queueBox.GetSelection()
+	queue.Cancel(row)
+	updateQueueBox()
+}
+
+func clearFinished() {
+	queue.ClearFinished()
+	updateQueueBox()
+}
+
+// formatMB renders a byte count in megabytes
+func formatMB(n int64) string {
+	return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
 }
 
 func updateLogBox() {
@@ -444,7 +864,7 @@ func toggleSelection(index int) {
 }
 
 func selectAll() {
-	for i := 0; i < len(photos); i++ {
+	for i := 0; i < len(groups); i++ {
 		selected[i] = true
 	}
 	updatePhotoList()
@@ -470,37 +890,697 @@ func updatePhotoCount() {
 	photoCountBox.SetText(fmt.Sprintf("[yellow]%d selected\n[purple]%d on camera\n[green]%d downloaded", count, cameraPhotos, downloadedPhotos))
 }
 
-func scanCameraPhotos() {
-	switch cfg.ConnectionMethod {
-	case lib.ConnectionMethodUSB:
-		lib.ScanCameraUsb(&photos, cfg)
-	case lib.ConnectionMethodWiFi:
-		lib.ScanCameraWiFi(&photos, cfg.Mock)
-	default:
-		fmt.Errorf("Unknown connection method specified, check config: %s", cfg.ConnectionMethod)
-		syscall.Exit(1)
+// emitScan writes a scan event when the number of photos on the camera or of
+// new ones has changed since the last one
+func emitScan() {
+	newPhotos := 0
+	for _, name := range photos {
+		if !existingFiles[name] {
+			newPhotos++
+		}
+	}
+	if scan := [2]int{len(photos), newPhotos}; scan != lastScan {
+		lastScan = scan
+		lib.EmitScan(scan[0], scan[1])
 	}
 }
 
-func main() {
-	var err error
-	cfg, _ = lib.LoadConfig()
-	err = lib.EnsureDownloadDir(cfg.DownloadDir)
+// currentPhoto returns the file to preview for the highlighted row
+func currentPhoto() string {
+	if currentItem < 0 || currentItem >= len(groups) {
+		return ""
+	}
+	return groups[currentItem].Primary()
+}
+
+// setRating rates the selected photos, 0 clears the rating
+func setRating(rating int) {
+	rows := selectedRows()
+	for _, i := range rows {
+		tags := lib.TagsFor(groups[i].Base)
+		tags.Rating = rating
+		if err := lib.SetTags(groups[i].Base, tags); err != nil {
+			lib.WriteLog(fmt.Sprintf("[red]%s - Couldn't save the rating: %v", time.Now().Format("2006-01-02 15:04:05"), err))
+			break
+		}
+	}
+	updateSidecars(rows)
+	updatePhotoList()
+	updateMetadata(currentItem, true)
+}
+
+// editKeywords asks for comma separated keywords for the selected photos
+func editKeywords() {
+	rows := selectedRows()
+	if len(rows) == 0 {
+		return
+	}
+	input := tview.NewInputField().
+		SetLabel("Keywords: ").
+		SetText(strings.Join(lib.TagsFor(groups[rows[0]].Base).Keywords, ", ")).
+		SetFieldWidth(0)
+	input.SetDoneFunc(func(key tcell.Key) {
+		pages.RemovePage("keywords")
+		setAppFocus(nil, photoListBox)
+		if key != tcell.KeyEnter {
+			return
+		}
+		keywords := lib.ParseKeywords(input.GetText())
+		for _, i := range rows {
+			tags := lib.TagsFor(groups[i].Base)
+			tags.Keywords = keywords
+			if err := lib.SetTags(groups[i].Base, tags); err != nil {
+				lib.WriteLog(fmt.Sprintf("[red]%s - Couldn't save the keywords: %v", time.Now().Format("2006-01-02 15:04:05"), err))
+				break
+			}
+		}
+		updateSidecars(rows)
+		updateMetadata(currentItem, true)
+	})
+	input.SetBorder(true).SetTitle(fmt.Sprintf("Keywords for %d photos (comma separated, Enter to save, Esc to cancel)", len(rows)))
+
+	modal := tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(input, 3, 0, true).
+			AddItem(nil, 0, 1, false), 0, 2, true).
+		AddItem(nil, 0, 1, false)
+	pages.AddPage("keywords", modal, true, true)
+	app.SetFocus(input)
+}
+
+// updateSidecars rewrites the XMP sidecars of already imported photos after
+// their tags change
+func updateSidecars(rows []int) {
+	if !cfg.XmpSidecar {
+		return
+	}
+	var files []string
+	for _, i := range rows {
+		for _, name := range groups[i].Files {
+			if existingFiles[name] {
+				files = append(files, name)
+			}
+		}
+	}
+	go func() {
+		for _, name := range files {
+			if err := lib.WriteXmpSidecar(name, lib.ImportedPath(name, cfg), cfg); err != nil {
+				lib.WriteLog(fmt.Sprintf("[red]%s - Couldn't write XMP sidecar for %s: %v", time.Now().Format("2006-01-02 15:04:05"), name, err))
+			}
+		}
+	}()
+}
+
+// toggleFormatFilter cycles between acting on both files of a RAW+JPEG pair,
+// only the JPEG or only the DNG
+func toggleFormatFilter() {
+	formatFilter = formatFilter.Next()
+	photoListBox.SetTitle(photoListTitle())
+	updatePhotoList()
+}
+
+func photoListTitle() string {
+	if cfg.ActiveProfile != "" {
+		return fmt.Sprintf("Camera Photos - %s (%s)", cfg.ActiveProfile, formatFilter)
+	}
+	return fmt.Sprintf("Camera Photos (%s)", formatFilter)
+}
+
+// profileList lists the profiles of the config file, plus the settings at its
+// top for no profile, and calls onSelect with the chosen one
+func profileList(onSelect func(name string)) *tview.List {
+	list := tview.NewList().SetHighlightFullLine(true)
+	for _, name := range append([]string{""}, fileCfg.ProfileNames()...) {
+		c, _ := fileCfg.WithProfile(name)
+		source := c.WifiSettings.Host
+		if c.ConnectionMethod == lib.ConnectionMethodUSB {
+			source = c.UsbSettings.CameraDir
+		}
+		label := name
+		if name == "" {
+			label = "No profile"
+		}
+		list.AddItem(label, fmt.Sprintf("%s %s → %s", c.ConnectionMethod, source, c.DownloadDir), 0, func() {
+			onSelect(name)
+		})
+		if name == cfg.ActiveProfile {
+			list.SetCurrentItem(list.GetItemCount() - 1)
+		}
+	}
+	list.SetBorder(true).SetTitle("Camera profile (Enter to choose)")
+	return list
+}
+
+// pickProfile asks which profile to use before the TUI starts
+func pickProfile() string {
+	choice := ""
+	pickApp := tview.NewApplication()
+	list := profileList(func(name string) {
+		choice = name
+		pickApp.Stop()
+	})
+	if err := pickApp.SetRoot(list, true).Run(); err != nil {
+		fmt.Println(err)
+	}
+	return choice
+}
+
+// chooseProfile switches between the profiles of the config file
+func chooseProfile() {
+	if len(fileCfg.Profiles) == 0 {
+		lib.WriteLog(fmt.Sprintf("[yellow]%s - There are no profiles in the config", time.Now().Format("2006-01-02 15:04:05")))
+		return
+	}
+	list := profileList(func(name string) {
+		pages.RemovePage("profiles")
+		setAppFocus(nil, photoListBox)
+		switchProfile(name)
+	})
+	list.SetDoneFunc(func() {
+		pages.RemovePage("profiles")
+		setAppFocus(nil, photoListBox)
+	})
+	modal := tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(list, 2*len(fileCfg.Profiles)+4, 0, true).
+			AddItem(nil, 0, 1, false), 0, 2, true).
+		AddItem(nil, 0, 1, false)
+	pages.AddPage("profiles", modal, true, true)
+	app.SetFocus(list)
+}
+
+func switchProfile(name string) {
+	if busy := busyWithCamera(); busy != "" {
+		lib.WriteLog(fmt.Sprintf("[red]%s - %s before switching profiles", time.Now().Format("2006-01-02 15:04:05"), busy))
+		return
+	}
+	newCfg, err := effectiveConfig(fileCfg, name)
+	if err == nil {
+		err = lib.ValidateConfig(newCfg)
+	}
 	if err != nil {
+		modal := tview.NewModal().
+			SetText("[red]" + tview.Escape(err.Error())).
+			AddButtons([]string{"OK"}).
+			SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+				pages.RemovePage("modal")
+			})
+		pages.AddPage("modal", modal, true, true)
 		return
 	}
-	lib.ScanDownloadDir(existingFiles, cfg)
+	applyConfig(newCfg)
+}
+
+// busyWithCamera says what has to finish before the config can be switched,
+// or returns "" if nothing is using the camera
+func busyWithCamera() string {
+	for _, item := range queue.Items() {
+		if item.State == lib.QueuePending || item.State == lib.QueueActive {
+			return "Finish or cancel the queued downloads"
+		}
+	}
+	if deleting > 0 {
+		return "Wait for the photos being deleted from the camera"
+	}
+	return ""
+}
+
+// applyConfig switches to newCfg while the TUI is running. The photo list is
+// emptied and filled again once the camera newCfg points at can be reached.
+func applyConfig(newCfg lib.Config) {
+	cfg = newCfg
+	lib.SetHost(cfg.WifiSettings.Host)
+	if err := lib.EnsureDownloadDir(cfg.DownloadDir); err != nil {
+		lib.WriteLog(fmt.Sprintf("[red]%s - Couldn't create download directory: %v", time.Now().Format("2006-01-02 15:04:05"), err))
+	}
+	lib.ForgetCaptures()
+
+	// Scans still running for the old config are dropped
+	configGen++
+	rescanning = true
+	photos, groups = nil, nil
+	selected = make(map[int]bool)
+	existingFiles = make(map[string]bool)
+	collisions = make(map[string]bool)
+	photoListBox.SetTitle(photoListTitle())
+	updatePhotoList()
+	updatePhotoCount()
+	updateMetadata(currentItem, true)
+
+	if rescanCancel != nil {
+		rescanCancel()
+	}
+	var ctx context.Context
+	ctx, rescanCancel = context.WithCancel(context.Background())
+	lib.WriteLog(fmt.Sprintf("[yellow]%s - Waiting for the camera via %s", time.Now().Format("2006-01-02 15:04:05"), cfg.ConnectionMethod))
+	lib.EmitConnection("waiting", cfg.ConnectionMethod)
+	go rescanCamera(ctx, cfg, configGen)
+}
+
+// rescanCamera waits for the camera of c to be reachable, then lists its
+// photos and checks which of them are already downloaded. The result is
+// dropped if the config changed again in the meantime.
+func rescanCamera(ctx context.Context, c lib.Config, gen int) {
+	for !lib.CameraConnected(c) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(connectionPollInterval):
+		}
+	}
+	lib.EmitConnection("connected", c.ConnectionMethod)
+	scan, err := scanPhotos(c)
+
+	app.QueueUpdateDraw(func() {
+		if gen != configGen {
+			return
+		}
+		// Let the periodic scan take over again
+		rescanning = false
+		if err != nil {
+			lib.WriteLog(fmt.Sprintf("[red]%s - %v", time.Now().Format("2006-01-02 15:04:05"), err))
+			return
+		}
+		scan.apply()
+		updateMetadata(currentItem, true)
+		lib.WriteLog(fmt.Sprintf("[yellow]%s - Found %d photos on the camera", time.Now().Format("2006-01-02 15:04:05"), len(photos)))
+	})
+}
+
+// cameraScan is what was on the camera and in the download directory at the
+// time of a scan
+type cameraScan struct {
+	photos     []string
+	existing   map[string]bool
+	collisions map[string]bool
+}
+
+// scanPhotos scans the camera and download directory of c. It doesn't touch
+// the photo list, so it can run off the UI goroutine.
+func scanPhotos(c lib.Config) (cameraScan, error) {
+	found, err := lib.ScanCamera(c)
+	if err != nil {
+		return cameraScan{}, err
+	}
+	existing := make(map[string]bool)
+	return cameraScan{photos: found, existing: existing, collisions: lib.ScanDownloadDir(existing, found, c)}, nil
+}
+
+// apply replaces the photo list with the scan, on the UI goroutine
+func (s cameraScan) apply() {
+	photos, groups = s.photos, lib.GroupPhotos(s.photos)
+	existingFiles, collisions = s.existing, s.collisions
+	emitScan()
+	updatePhotoList()
+	updatePhotoCount()
+}
+
+// refreshPhotos scans the camera again after photos were downloaded or
+// deleted. It blocks on the UI goroutine, so it must be called off it.
+func refreshPhotos() {
+	var c lib.Config
+	var gen int
+	app.QueueUpdate(func() {
+		c, gen = cfg, configGen
+	})
+	scan, err := scanPhotos(c)
+	app.QueueUpdateDraw(func() {
+		if gen != configGen {
+			return
+		}
+		if err != nil {
+			lib.WriteLog(fmt.Sprintf("[red]%s - Couldn't scan the camera again: %v", time.Now().Format("2006-01-02 15:04:05"), err))
+		} else {
+			scan.apply()
+		}
+		updateMetadata(currentItem, true)
+		updateLogBox()
+	})
+}
+
+// watchCamera rescans the camera every second. Each scan works on a copy of
+// the config and is applied on the UI goroutine, unless the config was
+// switched while it ran. Capture times cached for the path template are
+// dropped once the camera is back after a failed scan.
+func watchCamera() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	lost := false
+	for range ticker.C {
+		var c lib.Config
+		var gen int
+		var paused bool
+		app.QueueUpdate(func() {
+			c, gen, paused = cfg, configGen, rescanning
+		})
+		if paused {
+			lost = false
+			continue
+		}
+		// The card may have been swapped while the camera was away, so
+		// capture times cached before can belong to other photos now
+		wasLost := lost
+		if wasLost {
+			lib.ForgetCaptures()
+		}
+		scan, err := scanPhotos(c)
+		lost = err != nil
+		app.QueueUpdateDraw(func() {
+			if gen == configGen && !rescanning {
+				switch {
+				case err != nil && !wasLost:
+					lib.WriteLog(fmt.Sprintf("[red]%s - Lost the camera: %v", time.Now().Format("2006-01-02 15:04:05"), err))
+					lib.EmitConnection("disconnected", c.ConnectionMethod)
+				case err == nil && wasLost:
+					lib.WriteLog(fmt.Sprintf("[yellow]%s - Camera connected", time.Now().Format("2006-01-02 15:04:05")))
+					lib.EmitConnection("connected", c.ConnectionMethod)
+				}
+				if err == nil {
+					scan.apply()
+				}
+			}
+			updateLogo()
+			updateLogBox()
+		})
+	}
+}
+
+// editSettings opens a form for the settings of the config file. Saving checks
+// them, writes the file and applies them straight away. While a profile is in
+// use, its camera settings are edited instead of the ones they override.
+func editSettings() {
+	if busy := busyWithCamera(); busy != "" {
+		lib.WriteLog(fmt.Sprintf("[red]%s - %s before changing settings", time.Now().Format("2006-01-02 15:04:05"), busy))
+		return
+	}
+	profile := cfg.ActiveProfile
+	shown, _ := fileCfg.WithProfile(profile)
+	methods := []string{string(lib.ConnectionMethodUSB), string(lib.ConnectionMethodWiFi)}
+	filters := []string{string(lib.FormatBoth), string(lib.FormatJPEG), string(lib.FormatDNG)}
+	policies := []string{string(lib.CollisionSkip), string(lib.CollisionRename), string(lib.CollisionOverwrite)}
+	profiles := append([]string{"(none)"}, fileCfg.ProfileNames()...)
+	// Unknown values were refused when the config was loaded, and would show
+	// as the defaults here
+	filter, _ := lib.ParseFormatFilter(string(shown.FormatFilter))
+	policy, _ := lib.ParseCollisionPolicy(string(shown.CollisionPolicy))
+	defaultProfile := 0
+	for i, name := range profiles[1:] {
+		if name == shown.DefaultProfile {
+			defaultProfile = i + 1
+		}
+	}
+
+	// Settings given as flags win over the file for this run, so editing them
+	// here wouldn't change anything until the next start
+	flagged := make(map[string]string)
+	if *overrides.method != "" {
+		flagged["connection_method"] = "--method"
+	}
+	if *overrides.downloadDir != "" {
+		flagged["download_dir"] = "--download-dir"
+	}
+	if *overrides.cameraDir != "" {
+		flagged["usb.camera_dir"] = "--camera-dir"
+	}
+	if *overrides.host != "" {
+		flagged["wifi.host"] = "--host"
+	}
+	label := func(name string) string {
+		if flag, ok := flagged[name]; ok {
+			return fmt.Sprintf("%s (set by %s)", name, flag)
+		}
+		return name
+	}
+
+	form := tview.NewForm().SetItemPadding(0)
+	form.AddDropDown(label("connection_method"), methods, optionIndex(methods, string(shown.ConnectionMethod)), nil).
+		AddInputField(label("download_dir"), shown.DownloadDir, 0, nil, nil).
+		AddInputField("path_template", shown.PathTemplate, 0, nil, nil).
+		AddDropDown("format_filter", filters, optionIndex(filters, string(filter)), nil).
+		AddDropDown("collision_policy", policies, optionIndex(policies, string(policy)), nil).
+		AddCheckbox("xmp_sidecar", shown.XmpSidecar, nil).
+		AddInputField(label("usb.camera_dir"), shown.UsbSettings.CameraDir, 0, nil, nil).
+		AddCheckbox("usb.verify_checksum", shown.UsbSettings.VerifyChecksum, nil).
+		AddInputField(label("wifi.host"), shown.WifiSettings.Host, 0, nil, nil).
+		AddInputField("retry.attempts", strconv.Itoa(shown.Retry.Attempts), 0, nil, nil).
+		AddInputField("retry.backoff_seconds", strconv.FormatFloat(shown.Retry.BackoffSeconds, 'f', -1, 64), 0, nil, nil).
+		AddInputField("hooks.after_file", shown.Hooks.AfterFile, 0, nil, nil).
+		AddInputField("hooks.after_batch", shown.Hooks.AfterBatch, 0, nil, nil).
+		AddInputField("hooks.timeout_seconds", strconv.Itoa(shown.Hooks.TimeoutSeconds), 0, nil, nil).
+		AddDropDown("default_profile", profiles, defaultProfile, nil)
+	for name := range flagged {
+		form.GetFormItemByLabel(label(name)).SetDisabled(true)
+	}
+
+	text := func(name string) string {
+		return strings.TrimSpace(form.GetFormItemByLabel(label(name)).(*tview.InputField).GetText())
+	}
+	option := func(name string) string {
+		_, value := form.GetFormItemByLabel(label(name)).(*tview.DropDown).GetCurrentOption()
+		return value
+	}
+	checked := func(label string) bool {
+		return form.GetFormItemByLabel(label).(*tview.Checkbox).IsChecked()
+	}
+	closeSettings := func() {
+		pages.RemovePage("settings")
+		setAppFocus(nil, photoListBox)
+	}
+	showProblems := func(problems []string) {
+		modal := tview.NewModal().
+			SetText("[red]Settings not saved:\n[white]" + tview.Escape(strings.Join(problems, "\n"))).
+			AddButtons([]string{"OK"}).
+			SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+				pages.RemovePage("modal")
+				app.SetFocus(form)
+			})
+		pages.AddPage("modal", modal, true, true)
+	}
+
+	save := func() {
+		var problems []string
+		next := fileCfg
+		next.PathTemplate = text("path_template")
+		next.FormatFilter = lib.FormatFilter(option("format_filter"))
+		next.CollisionPolicy = lib.CollisionPolicy(option("collision_policy"))
+		next.XmpSidecar = checked("xmp_sidecar")
+		next.UsbSettings.VerifyChecksum = checked("usb.verify_checksum")
+		next.Hooks.AfterFile = text("hooks.after_file")
+		next.Hooks.AfterBatch = text("hooks.after_batch")
+		next.DefaultProfile = ""
+		if option("default_profile") != profiles[0] {
+			next.DefaultProfile = option("default_profile")
+		}
+
+		var err error
+		if next.Retry.Attempts, err = strconv.Atoi(text("retry.attempts")); err != nil {
+			problems = append(problems, "retry.attempts: not a whole number")
+		}
+		if next.Retry.BackoffSeconds, err = strconv.ParseFloat(text("retry.backoff_seconds"), 64); err != nil {
+			problems = append(problems, "retry.backoff_seconds: not a number")
+		}
+		if next.Hooks.TimeoutSeconds, err = strconv.Atoi(text("hooks.timeout_seconds")); err != nil {
+			problems = append(problems, "hooks.timeout_seconds: not a whole number")
+		}
+		downloadDir, err := absPath(text("download_dir"))
+		if err != nil {
+			problems = append(problems, "download_dir: "+err.Error())
+		}
+		cameraDir, err := absPath(text("usb.camera_dir"))
+		if err != nil {
+			problems = append(problems, "usb.camera_dir: "+err.Error())
+		}
+		method := lib.ConnectionMethod(option("connection_method"))
+		host := text("wifi.host")
+
+		if profile == "" {
+			next.ConnectionMethod = method
+			next.DownloadDir = downloadDir
+			next.UsbSettings.CameraDir = cameraDir
+			next.WifiSettings.Host = host
+		} else {
+			// Settings the profile doesn't have stay inherited unless they changed
+			p := fileCfg.Profiles[profile]
+			if method != fileCfg.ConnectionMethod || p.ConnectionMethod != "" {
+				p.ConnectionMethod = method
+			}
+			if downloadDir != fileCfg.DownloadDir || p.DownloadDir != "" {
+				p.DownloadDir = downloadDir
+			}
+			if cameraDir != fileCfg.UsbSettings.CameraDir || p.CameraDir != "" {
+				p.CameraDir = cameraDir
+			}
+			if host != fileCfg.WifiSettings.Host || p.Host != "" {
+				p.Host = host
+			}
+			next.Profiles = make(map[string]lib.Profile, len(fileCfg.Profiles))
+			for name, other := range fileCfg.Profiles {
+				next.Profiles[name] = other
+			}
+			next.Profiles[profile] = p
+		}
+		if len(problems) > 0 {
+			showProblems(problems)
+			return
+		}
+
+		newCfg, err := effectiveConfig(next, profile)
+		if err == nil {
+			err = lib.ValidateConfig(newCfg)
+		}
+		var cfgErr *lib.ConfigError
+		if errors.As(err, &cfgErr) {
+			showProblems(cfgErr.Problems)
+			return
+		} else if err != nil {
+			showProblems([]string{err.Error()})
+			return
+		}
+		newFilter, err := lib.ParseFormatFilter(string(newCfg.FormatFilter))
+		if err != nil {
+			showProblems([]string{"format_filter: " + err.Error()})
+			return
+		}
+		// A file that couldn't be read is kept, the form only showed defaults
+		var backup string
+		if brokenConfig {
+			backup, err = lib.ReplaceConfig(next)
+		} else {
+			err = lib.SaveConfig(next)
+		}
+		if err != nil {
+			showProblems([]string{fmt.Sprintf("couldn't write %s: %v", lib.DisplayConfigPath(), err)})
+			return
+		}
+
+		fileCfg = next
+		brokenConfig = false
+		formatFilter = newFilter
+		closeSettings()
+		lib.WriteLog(fmt.Sprintf("[yellow]%s - Saved settings to %s", time.Now().Format("2006-01-02 15:04:05"), lib.DisplayConfigPath()))
+		if backup != "" {
+			lib.WriteLog(fmt.Sprintf("[yellow]%s - The old config was moved to %s", time.Now().Format("2006-01-02 15:04:05"), backup))
+		}
+		applyConfig(newCfg)
+	}
+	form.AddButton("Save", save).
+		AddButton("Cancel", closeSettings).
+		SetCancelFunc(closeSettings)
+
+	title := "Settings"
+	if profile != "" {
+		title = fmt.Sprintf("Settings (camera settings of profile %s)", profile)
+	}
+	if brokenConfig {
+		title = "Settings (defaults, saving moves the old config aside)"
+	}
+	form.SetBorder(true).SetTitle(title + " - Tab to move, Esc to cancel")
+
+	modal := tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(form, form.GetFormItemCount()+6, 0, true).
+			AddItem(nil, 0, 1, false), 0, 3, true).
+		AddItem(nil, 0, 1, false)
+	pages.AddPage("settings", modal, true, true)
+	app.SetFocus(form)
+}
+
+// optionIndex is the index of value in options, or 0 when it isn't there
+func optionIndex(options []string, value string) int {
+	for i, option := range options {
+		if option == value {
+			return i
+		}
+	}
+	return 0
+}
+
+// absPath makes a directory typed into the settings absolute, expanding ~
+func absPath(dir string) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+	if dir == "~" || strings.HasPrefix(dir, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, dir[1:])
+	}
+	return filepath.Abs(dir)
+}
+
+func main() {
+	auto := flag.Bool("auto", false, "download every photo not yet imported as soon as the camera connects, then exit")
+	loop := flag.Bool("loop", false, "with --auto, wait for the camera to reconnect after each import instead of exiting")
+	overrides = registerConfigFlags()
+	eventsPath := flag.String("events", "", "write NDJSON events to this file, - for stdout")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), commandUsage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	tui := flag.NArg() == 0 && !*auto
+	if *eventsPath != "" {
+		if err := setupEvents(*eventsPath, tui); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitError)
+		}
+	}
+
+	if *overrides.file != "" {
+		lib.SetConfigFile(*overrides.file)
+	}
+	loadConfig(tui)
+	lib.SetHost(cfg.WifiSettings.Host)
+	if err := lib.EnsureDownloadDir(cfg.DownloadDir); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't create download directory:", err)
+		os.Exit(exitError)
+	}
+	// Clean up temp files left behind by a crash, keeping recent ones for resuming
+	lib.SweepStaleParts(cfg.DownloadDir, stalePartAge)
+	if err := lib.LoadManifest(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read import manifest:", err)
+	}
+	if err := lib.LoadTags(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read ratings and keywords:", err)
+	}
+
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+	if *auto {
+		os.Exit(runAutoImport(*loop, plainLog))
+	}
 
 	// does this run every frame?
 	lib.WaitForConnection(cfg)
 
-	scanCameraPhotos()
+	scan, err := scanPhotos(cfg)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(exitError)
+	}
+	photos, groups = scan.photos, lib.GroupPhotos(scan.photos)
+	existingFiles, collisions = scan.existing, scan.collisions
+	emitScan()
 
 	app = tview.NewApplication()
 	photoListBox = tview.NewList()
 	photoListBox.ShowSecondaryText(false)
 	photoListBox.SetBorder(true)
-	photoListBox.SetTitle("Camera Photos")
+	if formatFilter, err = lib.ParseFormatFilter(string(cfg.FormatFilter)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+	photoListBox.SetTitle(photoListTitle())
 	photoListBox.SetHighlightFullLine(true)
 	photoListBox.SetSelectedBackgroundColor(tcell.ColorBlue)
 	photoListBox.SetSelectedTextColor(tcell.ColorWhite)
@@ -530,6 +1610,27 @@ func main() {
 	logBox.SetTitle("Log")
 	logBox.SetScrollable(true)
 
+	queueBox = tview.NewTable()
+	queueBox.SetBorder(true)
+	queueBox.SetTitle("Queue")
+	queueBox.SetSelectable(true, false)
+	queueBox.SetSelectedStyle(tcell.StyleDefault.Background(tcell.ColorBlue).Foreground(tcell.ColorWhite))
+
+	// Downloads run in the background so the UI stays usable
+	queue = lib.NewQueue(transferPhoto, func(name string) int64 {
+		return lib.SourceSize(name, cfg)
+	})
+	queue.OnChange = func() {
+		// Changes can come from the UI itself, so don't wait for the redraw
+		go app.QueueUpdateDraw(func() {
+			updateQueueBox()
+			updatePhotoList()
+			updateLogBox()
+		})
+	}
+	queue.OnIdle = onQueueIdle
+	go queue.Run(context.Background())
+
 	updatePhotoCount()
 
 	photoListBox.SetChangedFunc(func(index int, main string, secondary string, shortcut rune) {
@@ -541,21 +1642,36 @@ func main() {
 		app,
 		photoListBox,
 		&currentItem,
-		photos,
+		currentPhoto,
 		pages,
 		logBox,
 		setAppFocus,
 		itemIsSelected,
 		toggleSelection,
 		downloadSelected,
+		moveSelected,
+		deleteSelected,
+		retryFailed,
 		selectAll,
 		deselectAll,
+		toggleFormatFilter,
+		setRating,
+		editKeywords,
+		chooseProfile,
+		editSettings,
 		renderPreviewModal,
+		queueBox,
+		togglePause,
+		cancelQueue,
+		moveQueueItem,
+		cancelQueueItem,
+		clearFinished,
 	)
 
 	updatePhotoList()
 	updateMetadata(currentItem, true)
 	updatePhotoCount()
+	updateQueueBox()
 	updateLogo()
 
 	// if terminal height is > 22, 3 boxes can be stacked
@@ -570,26 +1686,18 @@ func main() {
 		AddItem(metadataBox, 0, 1, false).
 		SetDirection(tview.FlexColumn)
 
+	photosAndQueueFlex := tview.NewFlex().
+		AddItem(photosAndInfoFlex, 0, 1, false).
+		AddItem(queueBox, 8, 0, false).
+		SetDirection(tview.FlexRow)
+
 	layout = tview.NewFlex().
 		AddItem(logoFlex, 0, 1, false).
-		AddItem(photosAndInfoFlex, 0, 3, false)
+		AddItem(photosAndQueueFlex, 0, 3, false)
 
 	pages.AddPage("main", layout, true, true)
 
-	go func() {
-		ticker := time.NewTicker(1 * time.Second) // scan every 2 seconds
-		defer ticker.Stop()
-		for range ticker.C {
-			scanCameraPhotos()
-			lib.ScanDownloadDir(existingFiles, cfg)
-			app.QueueUpdateDraw(func() {
-				updatePhotoList()
-				updatePhotoCount()
-				updateLogo()
-				updateLogBox()
-			})
-		}
-	}()
+	go watchCamera()
 
 	app.SetBeforeDrawFunc(func(screen tcell.Screen) bool {
 		termWidth, termHeight = screen.Size()